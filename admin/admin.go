@@ -0,0 +1,124 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/zjx20/urlproxy/logger"
+	"github.com/zjx20/urlproxy/reloaded"
+	"github.com/zjx20/urlproxy/urlopts"
+)
+
+// Host is the pseudo target host reserved for admin endpoints, e.g.
+// http://127.0.0.1:8765/_urlproxy/transports. It's not a valid DNS name,
+// so it never conflicts with a real upstream.
+const Host = "_urlproxy"
+
+var (
+	token = flag.String("admin-token", "", "Token for accessing admin endpoints, "+
+		"passed by the X-Urlproxy-Admin-Token header or the token query parameter, "+
+		"admin endpoints are only accessible from loopback addresses if it's empty")
+
+	headerAdminToken = http.CanonicalHeaderKey("X-Urlproxy-Admin-Token")
+)
+
+var (
+	mux          = http.NewServeMux()
+	currentToken atomic.Value // string
+)
+
+// Register adds an admin endpoint. The path is relative to the admin host,
+// e.g. "/transports".
+func Register(path string, h http.HandlerFunc) {
+	mux.HandleFunc(path, h)
+}
+
+// Reload applies the latest value of the -admin-token flag.
+func Reload() {
+	currentToken.Store(reloaded.String("admin-token"))
+}
+
+func getToken() string {
+	if t, ok := currentToken.Load().(string); ok {
+		return t
+	}
+	Reload()
+	return getToken()
+}
+
+// TokenSet tells whether -admin-token is set.
+func TokenSet() bool {
+	return getToken() != ""
+}
+
+// fromLoopback tells whether the request comes from a loopback address.
+func fromLoopback(req *http.Request) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Authorized tells whether the request may access the admin endpoints. If
+// -admin-token is empty, only requests from loopback addresses may.
+func Authorized(req *http.Request) bool {
+	expected := getToken()
+	if expected == "" {
+		return fromLoopback(req)
+	}
+	given := req.Header.Get(headerAdminToken)
+	if given == "" {
+		given = req.URL.Query().Get("token")
+	}
+	return subtle.ConstantTimeCompare([]byte(given), []byte(expected)) == 1
+}
+
+// Claims tells whether the request is for the admin endpoints.
+func Claims(req *http.Request, opts *urlopts.Options) bool {
+	if req.URL.Scheme != "" {
+		// regular http proxy request
+		return false
+	}
+	host, _ := urlopts.OptHost.ValueFrom(opts)
+	return host == Host
+}
+
+func Handle(w http.ResponseWriter, req *http.Request, opts *urlopts.Options) bool {
+	if !Claims(req, opts) {
+		return false
+	}
+	if !Authorized(req) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("unauthorized"))
+		return true
+	}
+	mux.ServeHTTP(w, req)
+	return true
+}
+
+// WriteJSON responds v in indented json.
+func WriteJSON(w http.ResponseWriter, statusCode int, v any) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		logger.Errorf("marshal json failed, err: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(data)
+	w.Write([]byte("\n"))
+}
+
+// ServeOptions lists the defined options, so that clients can validate urls
+// ahead of time.
+func ServeOptions(w http.ResponseWriter, req *http.Request) {
+	WriteJSON(w, http.StatusOK, urlopts.Registry())
+}
@@ -0,0 +1,34 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthorized(t *testing.T) {
+	defer func(old string) {
+		*token = old
+		Reload()
+	}(*token)
+
+	req := httptest.NewRequest(http.MethodGet, "/_urlproxy/transports", nil)
+	remote := httptest.NewRequest(http.MethodGet, "/_urlproxy/transports", nil)
+	remote.RemoteAddr = "203.0.113.1:1234"
+
+	*token = ""
+	Reload()
+	req.RemoteAddr = "127.0.0.1:1234"
+	assert.True(t, Authorized(req))
+	req.RemoteAddr = "[::1]:1234"
+	assert.True(t, Authorized(req))
+	assert.False(t, Authorized(remote))
+
+	*token = "secret"
+	Reload()
+	assert.False(t, Authorized(req))
+	remote.Header.Set(headerAdminToken, "secret")
+	assert.True(t, Authorized(remote))
+}
@@ -1,20 +1,40 @@
 package app
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/zjx20/urlproxy/admin"
 	"github.com/zjx20/urlproxy/app/info"
+	"github.com/zjx20/urlproxy/cors"
 	"github.com/zjx20/urlproxy/handler"
 	"github.com/zjx20/urlproxy/hlsboost"
+	"github.com/zjx20/urlproxy/inspector"
 	"github.com/zjx20/urlproxy/kvstore"
 	"github.com/zjx20/urlproxy/logger"
 	"github.com/zjx20/urlproxy/proxy"
+	"github.com/zjx20/urlproxy/record"
+	"github.com/zjx20/urlproxy/reloaded"
+	"github.com/zjx20/urlproxy/session"
+	"github.com/zjx20/urlproxy/shortlink"
+	"github.com/zjx20/urlproxy/token"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 var (
-	bind = flag.String("bind", "0.0.0.0:8765", "Address to bind")
+	bind            = flag.String("bind", "0.0.0.0:8765", "Address to bind")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "Max duration for draining connections on SIGTERM")
+	enableH2c       = flag.Bool("h2c", true, "Accept HTTP/2 without TLS (h2c), e.g. from gRPC clients")
 
 	kvstoreDir       = flag.String("kvstore-dir", "./kvdata", "Directory of kvstore")
 	kvstoreCacheSize = flag.Uint("kvstore-cache-size", 128*1024, "Size of in-memory cache of kvstore")
@@ -22,12 +42,48 @@ var (
 
 func Run() {
 	flag.Parse()
+	explicit := explicitFlags()
+	if *configFile != "" {
+		cfg, err := loadConfig(*configFile)
+		if err == nil {
+			err = applyConfig(cfg, explicit, false)
+		}
+		if err != nil {
+			logger.Fatalf("load config failed, err: %v", err)
+			return
+		}
+	} else if err := applyVhosts(nil); err != nil {
+		logger.Fatalf("%v", err)
+		return
+	}
+	if *printConfig {
+		if err := dumpConfig(os.Stdout); err != nil {
+			logger.Fatalf("print config failed, err: %v", err)
+		}
+		return
+	}
+	if err := token.Init(); err != nil {
+		logger.Fatalf("init token failed, err: %v", err)
+		return
+	}
+	if minted, err := token.MintFromFlag(); minted {
+		if err != nil {
+			logger.Fatalf("mint token failed, err: %v", err)
+		}
+		return
+	}
+	if err := record.Init(); err != nil {
+		logger.Fatalf("init record/replay failed, err: %v", err)
+		return
+	}
+	kvstoreReady := false
 	if *kvstoreDir != "" {
 		err := kvstore.InitKVStore(*kvstoreDir, *kvstoreCacheSize)
 		if err != nil {
 			logger.Warnf("kvstore is unavailable because init failed, err: %v", err)
 		} else {
 			logger.Infof("kvstore is ready")
+			kvstoreReady = true
 		}
 	}
 	ln, err := net.Listen("tcp", *bind)
@@ -38,9 +94,124 @@ func Run() {
 	logger.Infof("listen to %s", ln.Addr().String())
 	info.SetListenAddr(ln.Addr())
 
+	// setup admin endpoints
+	admin.Register("/options", admin.ServeOptions)
+	admin.Register("/transports", proxy.ServeTransports)
+	admin.Register("/breakers", proxy.ServeBreakers)
+	admin.Register("/upstreams", proxy.ServeUpstreams)
+	admin.Register("/inspector", inspector.ServeList)
+	admin.Register("/inspector/stream", inspector.ServeStream)
+	admin.Register("/inspector/curl", inspector.ServeCurl)
+	admin.Register("/tokens", token.ServeMint)
+	admin.Register("/links", shortlink.ServeLinks)
+	admin.Register("/sessions", session.ServeSessions)
+
+	if token.Enabled() {
+		handler.RegisterExpander(token.Prefix, token.Expand)
+	}
+	if kvstoreReady {
+		// short links are stored in kvstore
+		handler.RegisterExpander(shortlink.Prefix, shortlink.Expand)
+	}
+
 	// setup handlers, order does matter
-	handler.Register(hlsboost.Handler())
-	handler.Register(proxy.Handle)
-	http.Serve(ln, http.HandlerFunc(handler.ServeHTTP))
+	handler.Register("admin", admin.Handle, admin.Claims)
+	handler.Register("hlsboost", hlsboost.Handler(), hlsboost.Claims)
+	handler.Register("proxy", proxy.Handle, nil)
+
+	var h http.Handler = http.HandlerFunc(handler.ServeHTTP)
+	srv := &http.Server{}
+	h2cConns := &sync.WaitGroup{}
+	if *enableH2c {
+		h2s := &http2.Server{}
+		// the h2c connections are hijacked from srv, registering h2s to
+		// srv makes Shutdown send GOAWAY to them
+		if err := http2.ConfigureServer(srv, h2s); err != nil {
+			logger.Fatalf("configure h2c failed, err: %v", err)
+			return
+		}
+		h = trackH2c(h2c.NewHandler(h, h2s), h2cConns)
+	}
+	srv.Handler = h
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(ln)
+	}()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for {
+		select {
+		case err := <-serveErr:
+			if !errors.Is(err, http.ErrServerClosed) {
+				logger.Errorf("serve failed, err: %v", err)
+			}
+			shutdown(srv, h2cConns)
+			return
+		case sig := <-sigCh:
+			if sig == syscall.SIGHUP {
+				reload(explicit)
+				continue
+			}
+			logger.Infof("received signal %s, shutting down", sig)
+			shutdown(srv, h2cConns)
+			return
+		}
+	}
+}
+
+func reload(explicit map[string]bool) {
+	if *configFile == "" {
+		logger.Warnf("no config file to reload")
+		return
+	}
+	cfg, err := loadConfig(*configFile)
+	if err == nil {
+		err = applyConfig(cfg, explicit, true)
+	}
+	if err != nil {
+		logger.Errorf("reload config failed, err: %v", err)
+		return
+	}
+	logger.SetDebug(reloaded.Bool("debug"))
+	admin.Reload()
+	cors.Reload()
+	proxy.Reload()
+	logger.Infof("config reloaded")
+}
+
+// trackH2c counts the h2c connections served by h. They are hijacked from
+// the http.Server, so its Shutdown doesn't wait for them.
+func trackH2c(h http.Handler, conns *sync.WaitGroup) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (r.Method == "PRI" && r.URL.Path == "*") ||
+			strings.EqualFold(r.Header.Get("Upgrade"), "h2c") {
+			conns.Add(1)
+			defer conns.Done()
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func shutdown(srv *http.Server, h2cConns *sync.WaitGroup) {
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Warnf("drain connections failed, err: %v", err)
+		srv.Close()
+	} else {
+		drained := make(chan struct{})
+		go func() {
+			h2cConns.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			logger.Warnf("drain h2c connections failed, err: %v", ctx.Err())
+		}
+	}
+	hlsboost.Shutdown()
+	kvstore.Close()
 	logger.Infof("exit")
 }
@@ -0,0 +1,325 @@
+package app
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+
+	"github.com/zjx20/urlproxy/proxy"
+	"github.com/zjx20/urlproxy/reloaded"
+	"github.com/zjx20/urlproxy/urlopts"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	configFile  = flag.String("config", "", "Path of the config file, see README for the format")
+	printConfig = flag.Bool("print-config", false, "Print the effective configuration and exit")
+
+	vhostBase    = flag.String("vhost-base", "", "Public url of urlproxy for the vhost mode, e.g. https://proxy.example.com, then www-example-com.proxy.example.com is routed to https://www.example.com")
+	vhostProfile = flag.String("vhost-profile", "", "Option profile for the vhosts encoded in host names")
+)
+
+const (
+	keyDefaults  = "defaults"
+	keyProfiles  = "profiles"
+	keyVhosts    = "vhosts"
+	keyUpstreams = "upstreams"
+)
+
+var (
+	// reloadableFlags are applied again when reloading the config file on
+	// SIGHUP, other flags only take effect at startup. Reloaded values are
+	// published by the reloaded package, the flags are left untouched.
+	reloadableFlags = map[string]bool{
+		"admin-token":            true,
+		"cors-allow-credentials": true,
+		"cors-allow-origins":     true,
+		"cors-max-age":           true,
+		"debug":                  true,
+		"file-root":              true,
+		"header-env-vars":        true,
+		"socks":                  true,
+		"socks-uds":              true,
+		"tpl-root":               true,
+		"vhost-base":             true,
+		"vhost-profile":          true,
+	}
+
+	// flags that make no sense in the config file
+	cmdlineOnlyFlags = map[string]bool{
+		"config":       true,
+		"mint-token":   true,
+		"print-config": true,
+	}
+)
+
+type config struct {
+	flags     map[string]string
+	defaults  *urlopts.Options
+	profiles  map[string]*urlopts.Options
+	vhosts    map[string]*urlopts.Vhost
+	upstreams map[string]*proxy.UpstreamConfig
+}
+
+func configError(path string, node *yaml.Node, format string, args ...any) error {
+	return fmt.Errorf("%s:%d: %s", path, node.Line, fmt.Sprintf(format, args...))
+}
+
+func parseOptionList(path string, node *yaml.Node) (*urlopts.Options, error) {
+	if node.Kind != yaml.SequenceNode {
+		return nil, configError(path, node, "should be a list of %sName=value",
+			urlopts.UrlOptionPrefix)
+	}
+	var items []string
+	for _, it := range node.Content {
+		if it.Kind != yaml.ScalarNode {
+			return nil, configError(path, it, "should be a string")
+		}
+		items = append(items, it.Value)
+	}
+	opts, err := urlopts.ParseList(items)
+	if err != nil {
+		return nil, configError(path, node, "%s", err)
+	}
+	return opts, nil
+}
+
+func loadConfig(path string) (*config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	cfg := &config{
+		flags:    map[string]string{},
+		defaults: &urlopts.Options{},
+	}
+	if len(doc.Content) == 0 {
+		// empty file
+		return cfg, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, configError(path, root, "should be a mapping")
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		switch key.Value {
+		case keyDefaults:
+			cfg.defaults, err = parseOptionList(path, value)
+			if err != nil {
+				return nil, err
+			}
+		case keyProfiles:
+			if value.Kind != yaml.MappingNode {
+				return nil, configError(path, value, "should be a mapping from name to options")
+			}
+			cfg.profiles = map[string]*urlopts.Options{}
+			for j := 0; j+1 < len(value.Content); j += 2 {
+				name := value.Content[j].Value
+				cfg.profiles[name], err = parseOptionList(path, value.Content[j+1])
+				if err != nil {
+					return nil, err
+				}
+			}
+		case keyVhosts:
+			cfg.vhosts, err = parseVhosts(path, value)
+			if err != nil {
+				return nil, err
+			}
+		case keyUpstreams:
+			cfg.upstreams, err = parseUpstreams(path, value)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			f := flag.Lookup(key.Value)
+			if f == nil || cmdlineOnlyFlags[key.Value] {
+				return nil, configError(path, key, "unknown flag %s", key.Value)
+			}
+			if value.Kind != yaml.ScalarNode {
+				return nil, configError(path, value, "%s: should be a scalar", key.Value)
+			}
+			if err := validateFlag(f, value.Value); err != nil {
+				return nil, configError(path, value, "%s: %s", key.Value, err)
+			}
+			cfg.flags[key.Value] = value.Value
+		}
+	}
+	for name, vh := range cfg.vhosts {
+		if _, ok := cfg.profiles[vh.Profile]; vh.Profile != "" && !ok {
+			return nil, fmt.Errorf("%s: unknown profile %s of vhost %s", path, vh.Profile, name)
+		}
+	}
+	for name, up := range cfg.upstreams {
+		hc := up.HealthCheck
+		if hc == nil || hc.Profile == "" {
+			continue
+		}
+		if _, ok := cfg.profiles[hc.Profile]; !ok {
+			return nil, fmt.Errorf("%s: unknown profile %s of upstream %s", path, hc.Profile, name)
+		}
+	}
+	return cfg, nil
+}
+
+func parseUpstreams(path string, node *yaml.Node) (map[string]*proxy.UpstreamConfig, error) {
+	if node.Kind != yaml.MappingNode {
+		return nil, configError(path, node, "should be a mapping from name to upstream group")
+	}
+	upstreams := map[string]*proxy.UpstreamConfig{}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		name, value := node.Content[i].Value, node.Content[i+1]
+		up := &proxy.UpstreamConfig{}
+		if err := value.Decode(up); err != nil {
+			return nil, configError(path, value, "%s: %s", name, err)
+		}
+		if err := up.Check(); err != nil {
+			return nil, configError(path, value, "%s: %s", name, err)
+		}
+		upstreams[name] = up
+	}
+	return upstreams, nil
+}
+
+func parseVhosts(path string, node *yaml.Node) (map[string]*urlopts.Vhost, error) {
+	if node.Kind != yaml.MappingNode {
+		return nil, configError(path, node, "should be a mapping from host name to target")
+	}
+	vhosts := map[string]*urlopts.Vhost{}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		name, value := node.Content[i].Value, node.Content[i+1]
+		vh := &urlopts.Vhost{}
+		if err := value.Decode(vh); err != nil {
+			return nil, configError(path, value, "%s: %s", name, err)
+		}
+		if vh.Target == "" {
+			return nil, configError(path, value, "%s: target is required", name)
+		}
+		vhosts[name] = vh
+	}
+	return vhosts, nil
+}
+
+// validateFlag checks the value by a scratch flag.Value of the same type,
+// so that the flag itself is untouched.
+func validateFlag(f *flag.Flag, value string) error {
+	t := reflect.TypeOf(f.Value)
+	if t.Kind() != reflect.Pointer {
+		return nil
+	}
+	scratch, ok := reflect.New(t.Elem()).Interface().(flag.Value)
+	if !ok {
+		return nil
+	}
+	return scratch.Set(value)
+}
+
+// explicitFlags returns flags that are set by the command line, they take
+// precedence over the config file.
+func explicitFlags() map[string]bool {
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	return explicit
+}
+
+// applyConfig validates the parts of the config that depend on each other
+// before applying any of them, so that a failed reload leaves the previous
+// config intact.
+func applyConfig(cfg *config, explicit map[string]bool, reloading bool) error {
+	if !reloading {
+		// nothing is running at startup, a failure is fatal anyway
+		for name, value := range cfg.flags {
+			if explicit[name] {
+				continue
+			}
+			if err := flag.Set(name, value); err != nil {
+				return fmt.Errorf("config %s: %w", name, err)
+			}
+		}
+	}
+	flags := map[string]string{}
+	if reloading {
+		flags = reloadedFlags(cfg, explicit)
+	}
+	flagValue := func(name string) string {
+		if value, ok := flags[name]; ok {
+			return value
+		}
+		return reloaded.String(name)
+	}
+	base, profile := flagValue("vhost-base"), flagValue("vhost-profile")
+	if err := urlopts.CheckVhosts(base, profile, cfg.vhosts); err != nil {
+		return fmt.Errorf("config vhosts: %w", err)
+	}
+	if reloading {
+		reloaded.Publish(flags)
+	}
+	urlopts.SetPresets(cfg.defaults, cfg.profiles)
+	proxy.SetUpstreams(cfg.upstreams)
+	return applyVhosts(cfg.vhosts)
+}
+
+// reloadedFlags returns the values of the reloadable flags from the config
+// file. The flags removed from the config file get their default values,
+// and the flags set by the command line keep their values.
+func reloadedFlags(cfg *config, explicit map[string]bool) map[string]string {
+	values := map[string]string{}
+	for name := range reloadableFlags {
+		if explicit[name] {
+			continue
+		}
+		if value, exists := cfg.flags[name]; exists {
+			values[name] = value
+		} else {
+			values[name] = flag.Lookup(name).DefValue
+		}
+	}
+	return values
+}
+
+func applyVhosts(vhosts map[string]*urlopts.Vhost) error {
+	if err := urlopts.SetVhosts(reloaded.String("vhost-base"), reloaded.String("vhost-profile"), vhosts); err != nil {
+		return fmt.Errorf("config vhosts: %w", err)
+	}
+	return nil
+}
+
+func optionList(opts *urlopts.Options) []string {
+	list := urlopts.ToList(opts)
+	sort.Strings(list)
+	return list
+}
+
+// dumpConfig writes the effective configuration in the format of the
+// config file.
+func dumpConfig(w io.Writer) error {
+	root := map[string]interface{}{}
+	flag.VisitAll(func(f *flag.Flag) {
+		if cmdlineOnlyFlags[f.Name] {
+			return
+		}
+		root[f.Name] = reloaded.Lookup(f.Name)
+	})
+	defaults, profiles := urlopts.Presets()
+	root[keyDefaults] = optionList(defaults)
+	ps := map[string][]string{}
+	for name, opts := range profiles {
+		ps[name] = optionList(opts)
+	}
+	root[keyProfiles] = ps
+	root[keyVhosts] = urlopts.Vhosts()
+	root[keyUpstreams] = proxy.Upstreams()
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	defer enc.Close()
+	return enc.Encode(root)
+}
@@ -0,0 +1,245 @@
+package cors
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/zjx20/urlproxy/reloaded"
+	"github.com/zjx20/urlproxy/urlopts"
+)
+
+var (
+	allowOrigins     = flag.String("cors-allow-origins", "*", "Comma-separated origins allowed by uOptCors, \"*\" allows any origin")
+	allowCredentials = flag.Bool("cors-allow-credentials", false, "Allow credentials (cookies) in cross-origin requests of uOptCors")
+	maxAge           = flag.Duration("cors-max-age", 10*time.Minute, "How long browsers can cache the preflight responses of uOptCors")
+)
+
+var (
+	current atomic.Value // *policy
+)
+
+// policy holds the flags that can be changed at runtime by Reload().
+type policy struct {
+	anyOrigin   bool
+	origins     map[string]bool
+	credentials bool
+	maxAge      time.Duration
+}
+
+func loadPolicy() *policy {
+	p := &policy{
+		origins:     map[string]bool{},
+		credentials: reloaded.Bool("cors-allow-credentials"),
+		maxAge:      reloaded.Duration("cors-max-age"),
+	}
+	for _, origin := range strings.Split(reloaded.String("cors-allow-origins"), ",") {
+		origin = strings.TrimSpace(origin)
+		if origin == "*" {
+			p.anyOrigin = true
+		} else if origin != "" {
+			p.origins[strings.ToLower(origin)] = true
+		}
+	}
+	return p
+}
+
+func getPolicy() *policy {
+	if p, ok := current.Load().(*policy); ok {
+		return p
+	}
+	p := loadPolicy()
+	current.Store(p)
+	return p
+}
+
+// Reload applies the latest values of the -cors-* flags.
+func Reload() {
+	current.Store(loadPolicy())
+}
+
+// Enabled tells whether uOptCors is on.
+func Enabled(opts *urlopts.Options) bool {
+	enabled, _ := urlopts.OptCors.ValueFrom(opts)
+	return enabled
+}
+
+// allowedOrigin returns the value of Access-Control-Allow-Origin for the
+// request, or "" if the origin is not allowed.
+func (p *policy) allowedOrigin(req *http.Request) string {
+	origin := req.Header.Get("Origin")
+	if p.anyOrigin && !p.credentials {
+		return "*"
+	}
+	if origin == "" {
+		return ""
+	}
+	if p.anyOrigin || p.origins[strings.ToLower(origin)] {
+		return origin
+	}
+	return ""
+}
+
+// SetHeaders replaces the CORS headers in header according to the policy.
+func SetHeaders(header http.Header, req *http.Request) {
+	p := getPolicy()
+	for k := range header {
+		if strings.HasPrefix(k, "Access-Control-") {
+			delete(header, k)
+		}
+	}
+	origin := p.allowedOrigin(req)
+	if origin == "" {
+		return
+	}
+	if origin != "*" && !strings.Contains(strings.Join(header.Values("Vary"), ","), "Origin") {
+		header.Add("Vary", "Origin")
+	}
+	header.Set("Access-Control-Allow-Origin", origin)
+	if p.credentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	var exposed []string
+	for k := range header {
+		if !strings.HasPrefix(k, "Access-Control-") && k != "Vary" {
+			exposed = append(exposed, k)
+		}
+	}
+	if len(exposed) > 0 {
+		sort.Strings(exposed)
+		header.Set("Access-Control-Expose-Headers", strings.Join(exposed, ", "))
+	}
+}
+
+// IsPreflight tells whether the request is a CORS preflight request.
+func IsPreflight(req *http.Request) bool {
+	return req.Method == http.MethodOptions &&
+		req.Header.Get("Origin") != "" &&
+		req.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// ServePreflight responds the preflight request locally, the requested
+// method and headers are allowed if the origin is allowed.
+func ServePreflight(w http.ResponseWriter, req *http.Request) {
+	p := getPolicy()
+	header := w.Header()
+	header.Add("Vary", "Origin")
+	header.Add("Vary", "Access-Control-Request-Method")
+	header.Add("Vary", "Access-Control-Request-Headers")
+	origin := p.allowedOrigin(req)
+	if origin == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	header.Set("Access-Control-Allow-Origin", origin)
+	header.Set("Access-Control-Allow-Methods", req.Header.Get("Access-Control-Request-Method"))
+	if h := req.Header.Get("Access-Control-Request-Headers"); h != "" {
+		header.Set("Access-Control-Allow-Headers", h)
+	}
+	if p.credentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if p.maxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(int(p.maxAge/time.Second)))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// responseWriter sets the CORS headers right before writing the header.
+type responseWriter struct {
+	http.ResponseWriter
+	req         *http.Request
+	wroteHeader bool
+}
+
+// Wrap returns a ResponseWriter that sets the CORS headers for every
+// response, no matter which handler serves the request.
+func Wrap(w http.ResponseWriter, req *http.Request) http.ResponseWriter {
+	return &responseWriter{ResponseWriter: w, req: req}
+}
+
+func (w *responseWriter) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		SetHeaders(w.Header(), w.req)
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *responseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, fmt.Errorf("hijacking is not supported")
+}
+
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// RewriteRequest rewrites Origin and Referer of the upstream request, which
+// point to urlproxy, to the target. req is the request to urlproxy.
+func RewriteRequest(proxyReq *http.Request, req *http.Request) {
+	target := &url.URL{Scheme: proxyReq.URL.Scheme, Host: proxyReq.URL.Host}
+	if proxyReq.Header.Get("Origin") != "" {
+		proxyReq.Header.Set("Origin", target.String())
+	}
+	if referer := proxyReq.Header.Get("Referer"); referer != "" {
+		proxyReq.Header.Set("Referer", targetOf(referer, req.Host, target))
+	}
+}
+
+// targetOf turns a urlproxied url into the url of its target. The origin of
+// fallback is returned if the target is unknown, and urls not pointing to
+// urlproxy are returned as is.
+func targetOf(raw string, proxyHost string, fallback *url.URL) string {
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() {
+		return fallback.String() + "/"
+	}
+	if !strings.EqualFold(u.Host, proxyHost) && !urlopts.IsVhost(u.Host) {
+		return raw
+	}
+	u = urlopts.DevhostURL(u)
+	u.Scheme = ""
+	u.Host = ""
+	u.Fragment = ""
+	after, opts := urlopts.Extract(u)
+	host, ok := urlopts.OptHost.ValueFrom(opts)
+	if !ok {
+		return fallback.String() + "/"
+	}
+	after.Scheme = "http"
+	if scheme, ok := urlopts.OptScheme.ValueFrom(opts); ok {
+		after.Scheme = strings.ToLower(scheme)
+	}
+	after.Host = host
+	if after.Path == "" {
+		after.Path = "/"
+	}
+	return after.String()
+}
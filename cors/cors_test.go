@@ -0,0 +1,43 @@
+package cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCors(t *testing.T) {
+	req := httptest.NewRequest(http.MethodOptions, "/example.com/api", nil)
+	req.Header.Set("Origin", "http://app.local")
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+	req.Header.Set("Access-Control-Request-Headers", "Content-Type")
+	assert.True(t, IsPreflight(req))
+	rec := httptest.NewRecorder()
+	ServePreflight(rec, req)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, "*", rec.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "PUT", rec.Header().Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "Content-Type", rec.Header().Get("Access-Control-Allow-Headers"))
+
+	// upstream CORS headers are replaced
+	rec = httptest.NewRecorder()
+	w := Wrap(rec, req)
+	w.Header().Set("Access-Control-Allow-Origin", "https://example.com")
+	w.Header().Set("X-Total", "10")
+	w.Write([]byte("ok"))
+	assert.Equal(t, "*", rec.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "X-Total", rec.Header().Get("Access-Control-Expose-Headers"))
+	_, ok := w.(http.Flusher)
+	assert.True(t, ok)
+
+	fallback := &url.URL{Scheme: "https", Host: "example.com"}
+	assert.Equal(t, "https://example.com/page?a=1",
+		targetOf("http://127.0.0.1:8765/uOptScheme=https/example.com/page?a=1", "127.0.0.1:8765", fallback))
+	assert.Equal(t, "https://example.com/",
+		targetOf("http://127.0.0.1:8765/", "127.0.0.1:8765", fallback))
+	assert.Equal(t, "https://other.com/page",
+		targetOf("https://other.com/page", "127.0.0.1:8765", fallback))
+}
@@ -9,6 +9,7 @@ require (
 	github.com/peterbourgon/diskv/v3 v3.0.1
 	github.com/stretchr/testify v1.6.1
 	golang.org/x/net v0.15.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -16,7 +17,7 @@ require (
 	github.com/google/btree v1.0.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/zbiljic/go-filelock v0.0.0-20170914061330-1dbf7103ab7d
-	gopkg.in/yaml.v3 v3.0.1 // indirect
+	golang.org/x/text v0.13.0 // indirect
 )
 
 replace github.com/etherlabsio/go-m3u8 => github.com/zjx20/go-m3u8 v1.0.1-0.20230502061040-54ef0d2790f0
@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+
+	"github.com/zjx20/urlproxy/admin"
+	"github.com/zjx20/urlproxy/proxy"
+	"github.com/zjx20/urlproxy/urlopts"
+)
+
+type explanation struct {
+	URL          string          `json:"url"`
+	Path         string          `json:"path"`
+	RegularProxy bool            `json:"regularProxy"`
+	Extract      *urlopts.Report `json:"extract"`
+	Options      []string        `json:"options"`
+	PresetError  string          `json:"presetError,omitempty"`
+	Handler      string          `json:"handler"`
+	Upstream     *proxy.Plan     `json:"upstream,omitempty"`
+}
+
+// serveExplain responds how the request would be handled, instead of
+// serving it.
+func serveExplain(w http.ResponseWriter, r *http.Request, before *url.URL,
+	opts *urlopts.Options, report *urlopts.Report, presetErr error) {
+	opts.Remove(urlopts.OptExplain)
+	options := append([]string{}, urlopts.ToList(opts)...)
+	sort.Strings(options)
+	e := &explanation{
+		URL:          before.String(),
+		Path:         r.URL.RequestURI(),
+		RegularProxy: r.URL.Scheme != "",
+		Extract:      report,
+		Options:      options,
+	}
+	if presetErr != nil {
+		e.PresetError = presetErr.Error()
+	} else {
+		e.Handler = claimer(r, opts)
+		if r.Method != http.MethodConnect && !admin.Claims(r, opts) {
+			e.Upstream = proxy.Describe(r, opts)
+		}
+	}
+	admin.WriteJSON(w, http.StatusOK, e)
+}
@@ -1,18 +1,42 @@
 package handler
 
 import (
+	"flag"
 	"net/http"
+	"net/url"
+	"strings"
 
+	"github.com/zjx20/urlproxy/admin"
+	"github.com/zjx20/urlproxy/cors"
 	"github.com/zjx20/urlproxy/logger"
+	"github.com/zjx20/urlproxy/token"
 	"github.com/zjx20/urlproxy/urlopts"
 )
 
 type (
 	HttpHandler func(http.ResponseWriter, *http.Request, *urlopts.Options) bool
+	// ClaimFunc tells whether the handler would serve the request, without
+	// serving it. It's used by the explain mode.
+	ClaimFunc func(*http.Request, *urlopts.Options) bool
+	// Expander turns the rest of the path after its prefix into a urlproxied
+	// url. It responds the error by itself and returns false on failure.
+	// trusted tells whether the url is accepted in the require-signed mode.
+	Expander func(w http.ResponseWriter, r *http.Request, rest string) (u *url.URL, trusted bool, ok bool)
+)
+
+type entry struct {
+	name   string
+	handle HttpHandler
+	claims ClaimFunc
+}
+
+var (
+	strictOptions = flag.Bool("strict-options", false, "Respond 400 if there is any unknown or invalid option, can be overridden by uOptStrict")
 )
 
 var (
-	stack []HttpHandler
+	stack     []entry
+	expanders = map[string]Expander{} // path prefix => expander
 )
 
 func defaultHandler(w http.ResponseWriter, r *http.Request, opts *urlopts.Options) bool {
@@ -21,16 +45,112 @@ func defaultHandler(w http.ResponseWriter, r *http.Request, opts *urlopts.Option
 	return true
 }
 
-func Register(handler HttpHandler) {
-	stack = append(stack, handler)
+// Register appends a handler to the stack. A nil claims means the handler
+// serves every request that reaches it.
+func Register(name string, handler HttpHandler, claims ClaimFunc) {
+	stack = append(stack, entry{
+		name:   name,
+		handle: handler,
+		claims: claims,
+	})
+}
+
+// RegisterExpander adds an expander for urls with the path prefix, e.g.
+// "/t/".
+func RegisterExpander(prefix string, expander Expander) {
+	expanders[prefix] = expander
+}
+
+// expand replaces r.URL if it matches an expander, it returns false if the
+// request has been responded. trusted tells whether the expanded url is
+// accepted in the require-signed mode.
+func expand(w http.ResponseWriter, r *http.Request) (trusted bool, ok bool) {
+	if r.URL.Scheme != "" {
+		return false, true
+	}
+	for prefix, expander := range expanders {
+		if !strings.HasPrefix(r.URL.Path, prefix) {
+			continue
+		}
+		u, trusted, ok := expander(w, r, strings.TrimPrefix(r.URL.Path, prefix))
+		if !ok {
+			return false, false
+		}
+		logger.Debugf("expanded %s to %s", r.URL.Path, u)
+		r.URL = u
+		return trusted, true
+	}
+	return false, true
+}
+
+func isStrict(opts *urlopts.Options) bool {
+	if strict, ok := urlopts.OptStrict.ValueFrom(opts); ok {
+		return strict
+	}
+	return *strictOptions
+}
+
+// claimer returns the name of the first handler that would serve the request.
+func claimer(r *http.Request, opts *urlopts.Options) string {
+	for _, e := range stack {
+		if e.claims == nil || e.claims(r, opts) {
+			return e.name
+		}
+	}
+	return "default"
 }
 
 func ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	logger.Debugf("ServeHTTP, url: %s", r.URL.String())
-	after, opts := urlopts.Extract(r.URL)
+	before := *r.URL
+	trusted := token.TakeInternal(r)
+	expandedTrusted, ok := expand(w, r)
+	if !ok {
+		return
+	}
+	after, opts, report := urlopts.ExtractRequest(r)
 	r.URL = &after
-	for _, h := range stack {
-		ok := h(w, r, opts)
+	if expandedTrusted {
+		// signed urls may reference environment variables in uOptHeader
+		opts.Trust()
+	}
+	// options in the url take precedence over the ones in headers. Headers
+	// are not signed, so they are ignored in the require-signed mode.
+	headerOpts := urlopts.TakeFromHeader(r.Header, report)
+	if !token.Required() || trusted {
+		opts.Merge(headerOpts)
+	}
+	if token.Required() && !trusted && !expandedTrusted && !admin.Claims(r, opts) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("signed url required"))
+		return
+	}
+	presetErr := urlopts.ApplyPresets(opts)
+	if explain, _ := urlopts.OptExplain.ValueFrom(opts); explain {
+		serveExplain(w, r, &before, opts, report, presetErr)
+		return
+	}
+	if presetErr != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(presetErr.Error()))
+		return
+	}
+	if len(report.Errors) > 0 && isStrict(opts) {
+		admin.WriteJSON(w, http.StatusBadRequest, map[string]any{
+			"error":   "unknown or invalid options",
+			"options": report.Errors,
+		})
+		return
+	}
+	if cors.Enabled(opts) {
+		if cors.IsPreflight(r) {
+			cors.ServePreflight(w, r)
+			return
+		}
+		w = cors.Wrap(w, r)
+	}
+	for _, e := range stack {
+		ok := e.handle(w, r, opts)
 		if ok {
 			return
 		}
@@ -0,0 +1,109 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zjx20/urlproxy/app/info"
+	"github.com/zjx20/urlproxy/proxy"
+)
+
+func TestMain(m *testing.M) {
+	Register("proxy", proxy.Handle, nil)
+	os.Exit(m.Run())
+}
+
+func serve(req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	ServeHTTP(rec, req)
+	return rec
+}
+
+func TestExplain(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet,
+		"/uOptSocks=127.0.0.1:1080/example.com/get?a=1&uOptDns=8.8.8.8:53&uOptExplain=true", nil)
+	req.Header.Set("X-Urlproxy-Opt-Header", "X-Test:1")
+	req.Header.Set("Proxy-Connection", "keep-alive")
+	rec := serve(req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var e explanation
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &e))
+	assert.Equal(t, "/get?a=1", e.Path)
+	assert.False(t, e.RegularProxy)
+	assert.Equal(t, "proxy", e.Handler)
+	assert.Equal(t, []string{"uOptSocks=127.0.0.1:1080"}, e.Extract.PathOptions)
+	assert.Contains(t, e.Extract.QueryOptions, "uOptDns=8.8.8.8:53")
+	assert.Equal(t, "example.com", e.Extract.HostFromPath)
+	assert.Equal(t, []string{"X-Urlproxy-Opt-Header: X-Test:1"}, e.Extract.HeaderOptions)
+	assert.Equal(t, []string{"uOptDns=8.8.8.8:53", "uOptHeader=X-Test:1",
+		"uOptHost=example.com", "uOptSocks=127.0.0.1:1080"}, e.Options)
+
+	require.NotNil(t, e.Upstream)
+	assert.Empty(t, e.Upstream.Error)
+	assert.Equal(t, "http://example.com/get?a=1", e.Upstream.Target)
+	assert.Equal(t, "1", e.Upstream.ForwardedHeaders.Get("X-Test"))
+	assert.Equal(t, []string{"Proxy-Connection"}, e.Upstream.DroppedHeaders)
+	assert.Equal(t, []string{"socks:127.0.0.1:1080", "dns:8.8.8.8:53"}, e.Upstream.Dialer)
+}
+
+func TestStrict(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	info.SetListenAddr(upstream.Listener.Addr())
+	host := upstream.Listener.Addr().String()
+
+	defer func(old bool) { *strictOptions = old }(*strictOptions)
+	for _, tc := range []struct {
+		flag    bool
+		options string
+		code    int
+	}{
+		{false, "uOptTimeoutMS=1000&uOptAntiCaching=maybe", http.StatusOK},
+		{false, "uOptTimeoutMS=1000&uOptStrict=true", http.StatusBadRequest},
+		{false, "uOptAntiCaching=maybe&uOptStrict=true", http.StatusBadRequest},
+		{false, "uOptAntiCaching=true&uOptStrict=true", http.StatusOK},
+		{true, "uOptTimeoutMS=1000", http.StatusBadRequest},
+		{true, "uOptTimeoutMS=1000&uOptStrict=false", http.StatusOK},
+		{true, "uOptTimeoutMs=1000", http.StatusOK},
+	} {
+		*strictOptions = tc.flag
+		rec := serve(httptest.NewRequest(http.MethodGet, "/"+host+"/?"+tc.options, nil))
+		assert.Equal(t, tc.code, rec.Code, "%v %s", tc.flag, tc.options)
+		if tc.code == http.StatusBadRequest {
+			var resp struct {
+				Error   string
+				Options []map[string]string
+			}
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+			assert.Len(t, resp.Options, 1)
+		} else {
+			assert.Equal(t, "ok", rec.Body.String())
+		}
+	}
+}
+
+func TestHeaderOptionsNotRelocated(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/next", http.StatusFound)
+	}))
+	defer upstream.Close()
+	info.SetListenAddr(upstream.Listener.Addr())
+	host := upstream.Listener.Addr().String()
+
+	req := httptest.NewRequest(http.MethodGet, "/"+host+"/start?uOptRewriteRedirect=true&uOptHeader=X-Url:1", nil)
+	req.Header.Set("X-Urlproxy-Opt-Header", "Authorization:Bearer secret")
+	rec := serve(req)
+	require.Equal(t, http.StatusFound, rec.Code)
+	loc := rec.Header().Get("Location")
+	assert.Contains(t, loc, "uOptHeader=X-Url:1")
+	assert.NotContains(t, loc, "Authorization")
+	assert.NotContains(t, loc, "secret")
+}
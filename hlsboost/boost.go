@@ -13,6 +13,7 @@ import (
 
 	"github.com/zjx20/urlproxy/ant"
 	"github.com/zjx20/urlproxy/app/info"
+	"github.com/zjx20/urlproxy/cors"
 	"github.com/zjx20/urlproxy/handler"
 	"github.com/zjx20/urlproxy/logger"
 	"github.com/zjx20/urlproxy/proxy"
@@ -33,12 +34,20 @@ func Handler() handler.HttpHandler {
 	}).handle
 }
 
+// Shutdown stops all playlists and removes their cache dirs.
+func Shutdown() {
+	globalManager().Shutdown()
+}
+
 type hlsBoost struct {
 	selfCli *SelfClient
 	mgr     *manager
 }
 
-func (h *hlsBoost) handle(w http.ResponseWriter, req *http.Request, opts *urlopts.Options) bool {
+// Claims tells whether the request is for HLSBoost. Note that HLSBoost
+// may still fallback to the normal proxying, e.g. the upstream doesn't
+// respond a valid playlist.
+func Claims(req *http.Request, opts *urlopts.Options) bool {
 	if _, exists := req.Header[headerSkipHLSBoost]; exists {
 		// a request from SelfClient
 		return false
@@ -47,12 +56,20 @@ func (h *hlsBoost) handle(w http.ResponseWriter, req *http.Request, opts *urlopt
 		return false
 	}
 	if urlopts.OptHLSSegment.ExistsIn(opts) {
-		return h.serveSegment(w, req, opts)
+		return urlopts.OptHLSPlaylist.ExistsIn(opts) &&
+			urlopts.OptHLSUser.ExistsIn(opts)
 	}
-	if urlopts.OptHLSBoost.ExistsIn(opts) {
-		return h.servePlaylist(w, req, opts)
+	return urlopts.OptHLSBoost.ExistsIn(opts)
+}
+
+func (h *hlsBoost) handle(w http.ResponseWriter, req *http.Request, opts *urlopts.Options) bool {
+	if !Claims(req, opts) {
+		return false
 	}
-	return false
+	if urlopts.OptHLSSegment.ExistsIn(opts) {
+		return h.serveSegment(w, req, opts)
+	}
+	return h.servePlaylist(w, req, opts)
 }
 
 func isShortUrl(req *http.Request) bool {
@@ -116,11 +133,11 @@ func (h *hlsBoost) serveSegment(w http.ResponseWriter, req *http.Request, opts *
 	if segSize > 0 {
 		logger.Debugf("segment %s, responded by ServeContent", seg.segId)
 		cont := toContent(req.Context(), seg, segSize)
-		w.Header().Add("Access-Control-Allow-Origin", "*")
+		allowAnyOrigin(w.Header(), opts)
 		http.ServeContent(w, req, req.URL.Path, time.Time{}, cont)
 	} else {
 		logger.Debugf("can't get size of segment %s, respond in stream", seg.segId)
-		w.Header().Add("Access-Control-Allow-Origin", "*")
+		allowAnyOrigin(w.Header(), opts)
 		w.WriteHeader(http.StatusOK)
 		buf := make([]byte, 8*1024)
 		off := int64(0)
@@ -166,7 +183,6 @@ func (h *hlsBoost) serveShortUrlSegment(w http.ResponseWriter, req *http.Request
 			segReq.Header.Set(header, val)
 		}
 	}
-	segReq.Header.Add("Access-Control-Allow-Origin", "*")
 	resp, err := http.DefaultClient.Do(segReq)
 	if err != nil {
 		logger.Errorf("serveShortUrlSegment error: %s", err)
@@ -310,11 +326,19 @@ func respondRewrittenM3U8(playlistURI string, pl *m3u8.Playlist, w http.Response
 	header.Add("Content-Type", "application/vnd.apple.mpegurl")
 	header.Add("Content-Length", strconv.FormatInt(int64(len(data)), 10))
 	header.Add("Cache-Control", "no-store, no-cache, must-revalidate")
-	header.Add("Access-Control-Allow-Origin", "*")
+	allowAnyOrigin(header, opts)
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(data))
 }
 
+// allowAnyOrigin lets any page play the stream. With uOptCors, the CORS
+// headers are set by the policy instead, see cors.Wrap().
+func allowAnyOrigin(header http.Header, opts *urlopts.Options) {
+	if !cors.Enabled(opts) {
+		header.Add("Access-Control-Allow-Origin", "*")
+	}
+}
+
 type readCloser struct {
 	io.Reader
 	io.Closer
@@ -102,3 +102,17 @@ func makeCacheDirForPlaylist(playlistId string, cacheDir string) (string, error)
 	locks[dirPath] = fl
 	return dirPath, nil
 }
+
+func removeCacheDir(dirPath string) {
+	locksMu.Lock()
+	defer locksMu.Unlock()
+	if err := os.RemoveAll(dirPath); err != nil {
+		logger.Errorf("failed to remove cache dir: %s, err: %s", dirPath, err)
+	} else {
+		logger.Infof("cache dir %s has been deleted", dirPath)
+	}
+	if fl, exists := locks[dirPath]; exists {
+		fl.Destroy()
+		delete(locks, dirPath)
+	}
+}
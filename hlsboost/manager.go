@@ -16,6 +16,7 @@ type manager struct {
 	mu          sync.Mutex
 	userMap     map[string]*user
 	playlistMap map[string]*playlist
+	done        chan struct{}
 }
 
 func globalManager() *manager {
@@ -23,6 +24,7 @@ func globalManager() *manager {
 		mgr = &manager{
 			userMap:     make(map[string]*user),
 			playlistMap: make(map[string]*playlist),
+			done:        make(chan struct{}),
 		}
 		go mgr.tidyLoop()
 	})
@@ -32,7 +34,12 @@ func globalManager() *manager {
 func (m *manager) tidyLoop() {
 	ticker := time.NewTicker(5 * time.Second)
 	defer ticker.Stop()
-	for range ticker.C {
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.done:
+			return
+		}
 		m.mu.Lock()
 		for uId, u := range m.userMap {
 			if active := u.CheckActive(1 * time.Minute); !active {
@@ -51,6 +58,23 @@ func (m *manager) tidyLoop() {
 	}
 }
 
+// Shutdown stops all playlists and removes their cache dirs.
+func (m *manager) Shutdown() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	select {
+	case <-m.done:
+		return
+	default:
+		close(m.done)
+	}
+	for pId, pl := range m.playlistMap {
+		pl.Stop()
+		delete(m.playlistMap, pId)
+		logger.Infof("playlist %s stopped", pId)
+	}
+}
+
 func (m *manager) GetOrAddPlaylistAcquired(id string, pl *playlist) (*playlist, bool) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
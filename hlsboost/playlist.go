@@ -141,6 +141,23 @@ func (p *playlist) Destroy() error {
 	return nil
 }
 
+// Stop cancels background works regardless of users, and removes the
+// cache dir. Segments in use will be destroyed once they are released.
+func (p *playlist) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cancel != nil {
+		p.cancel()
+	}
+	for _, seg := range p.segments {
+		seg.Destroy(true)
+	}
+	p.segments = nil
+	if p.cacheDir != "" {
+		removeCacheDir(p.cacheDir)
+	}
+}
+
 func (p *playlist) GetNewestSegments(count int) *m3u8.Playlist {
 	p.mu.Lock()
 	defer p.mu.Unlock()
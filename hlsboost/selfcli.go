@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/url"
 
+	"github.com/zjx20/urlproxy/token"
 	"github.com/zjx20/urlproxy/urlopts"
 )
 
@@ -39,11 +40,16 @@ func (h *SelfClient) Get(ctx context.Context, relativeToPath string, uri string,
 func (h *SelfClient) ToFinalUrl(relativeToPath string, uri string,
 	opts *urlopts.Options) string {
 	path := toUrlproxyURI(relativeToPath, uri, opts)
+	if u, err := url.Parse(path); err == nil && u.IsAbs() {
+		// a vhost url, requests to urlproxy itself should be path-style
+		path = urlopts.DevhostURL(u).String()
+	}
 	return fmt.Sprintf("%s://%s%s", h.scheme, h.addr, path)
 }
 
 func manipulateRequestToSkipHlsBoost(req *http.Request) *http.Request {
 	req.Header.Set(headerSkipHLSBoost, "true")
+	token.MarkInternal(req)
 	return req
 }
 
@@ -59,6 +65,8 @@ func toUrlproxyURI(relativeToPath string, uri string, opts *urlopts.Options) str
 	if err != nil {
 		return uri
 	}
+	// it may be a relocated vhost url
+	u = urlopts.DevhostURL(u)
 	u = urlopts.RelocateToUrlproxy(u, opts)
 	return u.String()
 }
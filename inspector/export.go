@@ -0,0 +1,241 @@
+package inspector
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zjx20/urlproxy/admin"
+	"github.com/zjx20/urlproxy/logger"
+)
+
+// ServeList responds the recent transactions, in HAR if "format=har".
+func ServeList(w http.ResponseWriter, req *http.Request) {
+	txs := global.list(filterFrom(req))
+	if req.URL.Query().Get("format") == "har" {
+		w.Header().Set("Content-Disposition", `attachment; filename="urlproxy.har"`)
+		admin.WriteJSON(w, http.StatusOK, toHAR(txs))
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, txs)
+}
+
+// ServeStream pushes new transactions by server-sent events.
+func ServeStream(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("streaming unsupported"))
+		return
+	}
+	sub := global.subscribe(filterFrom(req))
+	defer global.unsubscribe(sub)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case tx := <-sub.ch:
+			data, err := json.Marshal(tx)
+			if err != nil {
+				logger.Errorf("marshal transaction failed, err: %s", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", tx.Id, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// ServeCurl responds a curl command that reproduces the upstream request
+// of the transaction specified by "id".
+func ServeCurl(w http.ResponseWriter, req *http.Request) {
+	id, _ := strconv.ParseInt(req.URL.Query().Get("id"), 10, 64)
+	tx := global.get(id)
+	if tx == nil || tx.UpstreamURL == "" {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("transaction not found"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(toCurl(tx) + "\n"))
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func toCurl(tx *Transaction) string {
+	parts := []string{"curl"}
+	if tx.Method != http.MethodGet {
+		parts = append(parts, "-X", tx.Method)
+	}
+	parts = append(parts, shellQuote(tx.UpstreamURL))
+	var keys []string
+	for k := range tx.UpstreamHeader {
+		// skip internal markers
+		if strings.HasPrefix(k, "X-Urlproxy-") {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range tx.UpstreamHeader[k] {
+			parts = append(parts, "-H", shellQuote(k+": "+v))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harTimings struct {
+	Send    int64 `json:"send"`
+	Wait    int64 `json:"wait"`
+	Receive int64 `json:"receive"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            int64       `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type har struct {
+	Log struct {
+		Version string `json:"version"`
+		Creator struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"creator"`
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+func harHeaders(header http.Header) []harNameValue {
+	result := []harNameValue{}
+	for k, values := range header {
+		for _, v := range values {
+			result = append(result, harNameValue{Name: k, Value: v})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+func harQuery(rawUrl string) []harNameValue {
+	result := []harNameValue{}
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return result
+	}
+	for k, values := range u.Query() {
+		for _, v := range values {
+			result = append(result, harNameValue{Name: k, Value: v})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+func toHAR(txs []*Transaction) *har {
+	h := &har{}
+	h.Log.Version = "1.2"
+	h.Log.Creator.Name = "urlproxy"
+	h.Log.Creator.Version = "1"
+	h.Log.Entries = []harEntry{}
+	for _, tx := range txs {
+		e := harEntry{
+			StartedDateTime: tx.Time.Format(time.RFC3339Nano),
+			Time:            tx.DurationMs,
+			Request: harRequest{
+				Method:      tx.Method,
+				URL:         tx.UpstreamURL,
+				HTTPVersion: "HTTP/1.1",
+				Headers:     harHeaders(tx.UpstreamHeader),
+				QueryString: harQuery(tx.UpstreamURL),
+				HeadersSize: -1,
+				BodySize:    -1,
+			},
+			Response: harResponse{
+				Status:      tx.StatusCode,
+				StatusText:  http.StatusText(tx.StatusCode),
+				HTTPVersion: "HTTP/1.1",
+				Headers:     harHeaders(tx.RespHeader),
+				Content: harContent{
+					Size:     tx.RespBodySize,
+					MimeType: tx.RespHeader.Get("Content-Type"),
+					Text:     tx.RespBody,
+				},
+				RedirectURL: tx.RespHeader.Get("Location"),
+				HeadersSize: -1,
+				BodySize:    tx.RespBodySize,
+			},
+			Timings: harTimings{
+				Send:    0,
+				Wait:    tx.DurationMs,
+				Receive: 0,
+			},
+			Comment: tx.Error,
+		}
+		if tx.RespBodyBase64 {
+			e.Response.Content.Encoding = "base64"
+		}
+		if int64(len(tx.body)) < tx.RespBodySize {
+			e.Response.Content.Comment = "truncated"
+		}
+		h.Log.Entries = append(h.Log.Entries, e)
+	}
+	return h
+}
@@ -0,0 +1,306 @@
+package inspector
+
+import (
+	"encoding/base64"
+	"flag"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/zjx20/urlproxy/urlopts"
+)
+
+var (
+	ringSize  = flag.Int("inspector-size", 0, "Number of recent transactions kept by the inspector, 0 means disabled")
+	bodyLimit = flag.Int("inspector-body-limit", 4096, "Max bytes of the response body kept by the inspector")
+)
+
+// Transaction is a captured proxy request.
+type Transaction struct {
+	Id             int64       `json:"id"`
+	Time           time.Time   `json:"time"`
+	DurationMs     int64       `json:"durationMs"`
+	Client         string      `json:"client"`
+	Method         string      `json:"method"`
+	URL            string      `json:"url"`
+	Options        []string    `json:"options"`
+	UpstreamURL    string      `json:"upstreamUrl,omitempty"`
+	UpstreamHeader http.Header `json:"upstreamHeader,omitempty"`
+	StatusCode     int         `json:"statusCode,omitempty"`
+	RespHeader     http.Header `json:"respHeader,omitempty"`
+	RespBody       string      `json:"respBody,omitempty"`
+	RespBodyBase64 bool        `json:"respBodyBase64,omitempty"`
+	RespBodySize   int64       `json:"respBodySize"`
+	Error          string      `json:"error,omitempty"`
+
+	upstreamHost string
+	optHeader    http.Header // from uOptHeader, redacted from UpstreamHeader
+	body         []byte
+}
+
+const redacted = "REDACTED"
+
+// sensitiveHeaders are redacted from the captured headers, so are the
+// headers added by uOptHeader, which are usually credentials.
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+func redactHeader(h http.Header, extra http.Header) http.Header {
+	h = h.Clone()
+	for _, k := range sensitiveHeaders {
+		if _, ok := h[k]; ok {
+			h[k] = []string{redacted}
+		}
+	}
+	for k := range extra {
+		k = http.CanonicalHeaderKey(k)
+		if _, ok := h[k]; ok {
+			h[k] = []string{redacted}
+		}
+	}
+	return h
+}
+
+type subscriber struct {
+	ch     chan *Transaction
+	filter Filter
+}
+
+type inspector struct {
+	mu     sync.Mutex
+	nextId int64
+	ring   []*Transaction
+	head   int // position for the next transaction
+	subs   map[*subscriber]struct{}
+}
+
+var (
+	global = &inspector{
+		subs: map[*subscriber]struct{}{},
+	}
+)
+
+func enabled() bool {
+	return *ringSize > 0
+}
+
+// Begin starts capturing a proxy request, it returns nil if the inspector
+// is disabled. All methods of *Transaction are nil-safe.
+func Begin(req *http.Request, opts *urlopts.Options) *Transaction {
+	if !enabled() {
+		return nil
+	}
+	client, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		client = req.RemoteAddr
+	}
+	optHeader, _ := urlopts.OptHeader.ValueFrom(opts)
+	if len(optHeader) > 0 {
+		masked := http.Header{}
+		for k := range optHeader {
+			masked.Set(k, redacted)
+		}
+		opts = opts.Clone()
+		opts.Set(urlopts.OptHeader.New(masked))
+	}
+	list := urlopts.ToList(opts)
+	sort.Strings(list)
+	return &Transaction{
+		Time:      time.Now(),
+		Client:    client,
+		Method:    req.Method,
+		URL:       req.URL.String(),
+		Options:   list,
+		optHeader: optHeader,
+	}
+}
+
+// SetUpstream captures the final request to the upstream.
+func (tx *Transaction) SetUpstream(proxyReq *http.Request) {
+	if tx == nil {
+		return
+	}
+	tx.UpstreamURL = proxyReq.URL.String()
+	tx.UpstreamHeader = redactHeader(proxyReq.Header, tx.optHeader)
+	tx.upstreamHost = proxyReq.URL.Hostname()
+}
+
+// Fail finishes the transaction with an error.
+func (tx *Transaction) Fail(err error) {
+	if tx == nil {
+		return
+	}
+	tx.Error = err.Error()
+	global.commit(tx)
+}
+
+// SetResponse captures the response header, and the beginning of the body
+// while it's being read. The transaction is finished when the body is closed.
+func (tx *Transaction) SetResponse(resp *http.Response) {
+	if tx == nil {
+		return
+	}
+	if resp.Request != nil {
+		// the request that was actually sent, e.g. with uOptAntiCaching
+		tx.SetUpstream(resp.Request)
+	}
+	tx.StatusCode = resp.StatusCode
+	tx.RespHeader = redactHeader(resp.Header, nil)
+	resp.Body = &captureBody{ReadCloser: resp.Body, tx: tx}
+}
+
+type captureBody struct {
+	io.ReadCloser
+	tx   *Transaction
+	once sync.Once
+}
+
+func (b *captureBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.tx.RespBodySize += int64(n)
+	if room := *bodyLimit - len(b.tx.body); room > 0 && n > 0 {
+		if room > n {
+			room = n
+		}
+		b.tx.body = append(b.tx.body, p[:room]...)
+	}
+	return n, err
+}
+
+func (b *captureBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		global.commit(b.tx)
+	})
+	return err
+}
+
+func (in *inspector) commit(tx *Transaction) {
+	tx.DurationMs = time.Since(tx.Time).Milliseconds()
+	if utf8.Valid(tx.body) {
+		tx.RespBody = string(tx.body)
+	} else {
+		tx.RespBody = base64.StdEncoding.EncodeToString(tx.body)
+		tx.RespBodyBase64 = true
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.nextId++
+	tx.Id = in.nextId
+	if len(in.ring) != *ringSize {
+		// the size has been changed, or not initialized yet
+		in.ring = in.orderedLocked(*ringSize)
+		in.head = len(in.ring) % *ringSize
+		in.ring = append(in.ring, make([]*Transaction, *ringSize-len(in.ring))...)
+	}
+	in.ring[in.head] = tx
+	in.head = (in.head + 1) % len(in.ring)
+	for sub := range in.subs {
+		if !sub.filter.Match(tx) {
+			continue
+		}
+		select {
+		case sub.ch <- tx:
+		default:
+			// drop it for slow subscribers
+		}
+	}
+}
+
+// orderedLocked returns at most max transactions, from the oldest to the
+// newest.
+func (in *inspector) orderedLocked(max int) []*Transaction {
+	var result []*Transaction
+	for i := 0; i < len(in.ring); i++ {
+		tx := in.ring[(in.head+i)%len(in.ring)]
+		if tx != nil {
+			result = append(result, tx)
+		}
+	}
+	if len(result) > max {
+		result = result[len(result)-max:]
+	}
+	return result
+}
+
+func (in *inspector) list(filter Filter) []*Transaction {
+	in.mu.Lock()
+	all := in.orderedLocked(len(in.ring))
+	in.mu.Unlock()
+	result := []*Transaction{}
+	for _, tx := range all {
+		if filter.Match(tx) {
+			result = append(result, tx)
+		}
+	}
+	return result
+}
+
+func (in *inspector) get(id int64) *Transaction {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for _, tx := range in.ring {
+		if tx != nil && tx.Id == id {
+			return tx
+		}
+	}
+	return nil
+}
+
+func (in *inspector) subscribe(filter Filter) *subscriber {
+	sub := &subscriber{
+		ch:     make(chan *Transaction, 64),
+		filter: filter,
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.subs[sub] = struct{}{}
+	return sub
+}
+
+func (in *inspector) unsubscribe(sub *subscriber) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	delete(in.subs, sub)
+}
+
+// Filter selects transactions, empty fields match everything.
+type Filter struct {
+	Host   string
+	Status string // e.g. "404" or "5xx"
+	Client string
+}
+
+func filterFrom(req *http.Request) Filter {
+	q := req.URL.Query()
+	return Filter{
+		Host:   q.Get("host"),
+		Status: strings.ToLower(q.Get("status")),
+		Client: q.Get("client"),
+	}
+}
+
+func (f Filter) Match(tx *Transaction) bool {
+	if f.Host != "" && !strings.EqualFold(f.Host, tx.upstreamHost) {
+		return false
+	}
+	if f.Client != "" && f.Client != tx.Client {
+		return false
+	}
+	if f.Status != "" {
+		code := strconv.Itoa(tx.StatusCode)
+		if strings.HasSuffix(f.Status, "xx") {
+			if !strings.HasPrefix(code, strings.TrimSuffix(f.Status, "xx")) {
+				return false
+			}
+		} else if f.Status != code {
+			return false
+		}
+	}
+	return true
+}
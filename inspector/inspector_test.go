@@ -0,0 +1,96 @@
+package inspector
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zjx20/urlproxy/urlopts"
+)
+
+func enable(t *testing.T) {
+	old := *ringSize
+	*ringSize = 10
+	t.Cleanup(func() {
+		*ringSize = old
+		global = &inspector{subs: map[*subscriber]struct{}{}}
+	})
+}
+
+func capture(t *testing.T, host string, status int, body string) *Transaction {
+	u, _ := url.Parse("/" + host + "/path?uOptHeader=X-Api-Key:secret")
+	after, opts := urlopts.Extract(u)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.URL = &after
+	tx := Begin(req, opts)
+	require.NotNil(t, tx)
+
+	proxyReq := httptest.NewRequest(http.MethodGet, "http://"+host+"/path", nil)
+	proxyReq.Header.Set("X-Api-Key", "secret")
+	proxyReq.Header.Set("Authorization", "Bearer secret")
+	proxyReq.Header.Set("Accept", "*/*")
+	resp := &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Set-Cookie": {"sid=secret"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    proxyReq,
+	}
+	tx.SetResponse(resp)
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+	return tx
+}
+
+func TestCapture(t *testing.T) {
+	assert.Nil(t, Begin(httptest.NewRequest(http.MethodGet, "/", nil), &urlopts.Options{}))
+	enable(t)
+
+	tx := capture(t, "a.com", 200, "hello")
+	capture(t, "b.com", 502, "")
+
+	assert.Equal(t, "hello", tx.RespBody)
+	assert.Equal(t, int64(5), tx.RespBodySize)
+	assert.Equal(t, "*/*", tx.UpstreamHeader.Get("Accept"))
+	assert.Equal(t, redacted, tx.UpstreamHeader.Get("X-Api-Key"))
+	assert.Equal(t, redacted, tx.UpstreamHeader.Get("Authorization"))
+	assert.Equal(t, redacted, tx.RespHeader.Get("Set-Cookie"))
+	data, _ := json.Marshal(tx)
+	assert.NotContains(t, string(data), "secret")
+	assert.NotContains(t, toCurl(tx), "secret")
+
+	assert.Len(t, global.list(Filter{}), 2)
+	list := global.list(Filter{Status: "5xx"})
+	require.Len(t, list, 1)
+	assert.Equal(t, "b.com", list[0].upstreamHost)
+	assert.Len(t, global.list(Filter{Host: "A.com"}), 1)
+	assert.Equal(t, tx, global.get(tx.Id))
+}
+
+func TestStream(t *testing.T) {
+	enable(t)
+	server := httptest.NewServer(http.HandlerFunc(ServeStream))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/?host=b.com")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	capture(t, "a.com", 200, "a")
+	capture(t, "b.com", 200, "b")
+
+	rd := bufio.NewReader(resp.Body)
+	line, _ := rd.ReadString('\n')
+	assert.Equal(t, "id: 2\n", line)
+	line, _ = rd.ReadString('\n')
+	var tx Transaction
+	require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &tx))
+	assert.Equal(t, "b", tx.RespBody)
+}
@@ -5,11 +5,13 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+	"sync"
 
 	"github.com/peterbourgon/diskv/v3"
 )
 
 var (
+	mu          sync.RWMutex
 	globalDiskv *diskv.Diskv
 	nsRegex     = regexp.MustCompile("^[a-zA-Z0-9_]+$")
 )
@@ -52,10 +54,21 @@ func InitKVStore(dir string, cacheSize uint) error {
 	if err != nil {
 		return err
 	}
+	mu.Lock()
 	globalDiskv = d
+	mu.Unlock()
 	return nil
 }
 
+// Close waits for in-flight operations to finish, and then makes the
+// kvstore unavailable. There is nothing to flush, every Write has been
+// written to its file when it returns.
+func Close() {
+	mu.Lock()
+	defer mu.Unlock()
+	globalDiskv = nil
+}
+
 func checkNamespace(ns string) error {
 	if !nsRegex.MatchString(ns) {
 		return ErrBadNamespace
@@ -64,6 +77,8 @@ func checkNamespace(ns string) error {
 }
 
 func Write(ns string, key string, value string) error {
+	mu.RLock()
+	defer mu.RUnlock()
 	if globalDiskv == nil {
 		return ErrUnavailable
 	}
@@ -74,6 +89,8 @@ func Write(ns string, key string, value string) error {
 }
 
 func Read(ns string, key string) (string, error) {
+	mu.RLock()
+	defer mu.RUnlock()
 	if globalDiskv == nil {
 		return "", ErrUnavailable
 	}
@@ -83,3 +100,33 @@ func Read(ns string, key string) (string, error) {
 	}
 	return string(data), nil
 }
+
+func Delete(ns string, key string) error {
+	mu.RLock()
+	defer mu.RUnlock()
+	if globalDiskv == nil {
+		return ErrUnavailable
+	}
+	if err := checkNamespace(ns); err != nil {
+		return err
+	}
+	return globalDiskv.Erase(ns + "/" + key)
+}
+
+// Keys returns all keys in the namespace, in undefined order.
+func Keys(ns string) ([]string, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	if globalDiskv == nil {
+		return nil, ErrUnavailable
+	}
+	if err := checkNamespace(ns); err != nil {
+		return nil, err
+	}
+	prefix := ns + "/"
+	var keys []string
+	for key := range globalDiskv.KeysPrefix(prefix, nil) {
+		keys = append(keys, strings.TrimPrefix(key, prefix))
+	}
+	return keys, nil
+}
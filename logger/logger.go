@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sync/atomic"
 )
 
 var (
@@ -15,16 +16,24 @@ func init() {
 	log.SetFlags(log.Lshortfile | log.LstdFlags | log.Lmicroseconds)
 }
 
+var (
+	debugOverride atomic.Value // bool, overrides -debug once set
+)
+
+// SetDebug overrides the -debug flag, e.g. with the reloaded value.
 func SetDebug(v bool) {
-	*debug = v
+	debugOverride.Store(v)
 }
 
 func IsDebug() bool {
+	if v, ok := debugOverride.Load().(bool); ok {
+		return v
+	}
 	return *debug
 }
 
 func Debugf(format string, v ...any) {
-	if *debug {
+	if IsDebug() {
 		log.Output(2, fmt.Sprintf("[DEBUG] "+format, v...))
 	}
 }
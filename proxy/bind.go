@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zjx20/urlproxy/urlopts"
+)
+
+const (
+	// results of looking up interfaces are kept for a while, so that the
+	// interfaces are not listed for every request
+	ifaceCheckTTL  = 10 * time.Second
+	maxIfaceChecks = 256
+)
+
+var (
+	// requests rotate through the source addresses of uOptBindIp
+	bindSeq uint64
+
+	ifaceChecksMu sync.Mutex
+	ifaceChecks   = map[string]*ifaceCheck{} // name => result
+)
+
+type ifaceCheck struct {
+	err     error
+	checked time.Time
+}
+
+// checkIface tells whether the network interface exists.
+func checkIface(name string) error {
+	ifaceChecksMu.Lock()
+	c := ifaceChecks[name]
+	ifaceChecksMu.Unlock()
+	if c != nil && time.Since(c.checked) < ifaceCheckTTL {
+		return c.err
+	}
+	_, err := net.InterfaceByName(name)
+	ifaceChecksMu.Lock()
+	defer ifaceChecksMu.Unlock()
+	if len(ifaceChecks) >= maxIfaceChecks {
+		ifaceChecks = map[string]*ifaceCheck{}
+	}
+	ifaceChecks[name] = &ifaceCheck{err: err, checked: time.Now()}
+	return err
+}
+
+// bindIps parses uOptBindIp, a comma-separated pool of source addresses.
+func bindIps(opts *urlopts.Options) ([]net.IP, error) {
+	pool, ok := urlopts.OptBindIp.ValueFrom(opts)
+	if !ok || pool == "" {
+		return nil, nil
+	}
+	var ips []net.IP
+	for _, s := range strings.Split(pool, ",") {
+		ip := net.ParseIP(strings.TrimSpace(s))
+		if ip == nil {
+			return nil, fmt.Errorf("bad source address %s in uOptBindIp", s)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// checkBind validates the options for binding the local side of upstream
+// connections.
+func checkBind(opts *urlopts.Options) error {
+	if _, err := bindIps(opts); err != nil {
+		return err
+	}
+	if iface, ok := urlopts.OptBindIface.ValueFrom(opts); ok && iface != "" {
+		if err := checkIface(iface); err != nil {
+			return fmt.Errorf("bad interface %s in uOptBindIface, err: %s", iface, err)
+		}
+	}
+	return nil
+}
+
+// applyBind sets the source address, interface and address family of the
+// options to the dialer, and returns the part of the transport identifier
+// for them. A source address is picked from the pool for each call, with
+// peek it's the one the next call would pick.
+func applyBind(d *net.Dialer, opts *urlopts.Options, peek bool) (dialCtxFunc, string) {
+	var identifier string
+	if ips, _ := bindIps(opts); len(ips) > 0 {
+		seq := atomic.LoadUint64(&bindSeq) + 1
+		if !peek {
+			seq = atomic.AddUint64(&bindSeq, 1)
+		}
+		ip := ips[int(seq%uint64(len(ips)))]
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+		identifier += "[bind:" + ip.String() + "]"
+	}
+	if iface, ok := urlopts.OptBindIface.ValueFrom(opts); ok && iface != "" {
+		d.Control = bindToDevice(iface)
+		identifier += "[iface:" + iface + "]"
+	}
+	family, _ := urlopts.OptIpFamily.ValueFrom(opts)
+	if family != "" {
+		identifier += "[family:" + family + "]"
+	}
+	return dialFamily(d, family), identifier
+}
+
+// preferred tells whether the ip is in the family preferred by uOptIpFamily.
+func preferred(ip net.IP, family string) bool {
+	if strings.HasSuffix(family, "ipv6") {
+		return ip.To4() == nil
+	}
+	return ip.To4() != nil
+}
+
+// sortByFamily moves the addresses in the preferred family to the front.
+func sortByFamily(ips []net.IP, family string) {
+	if family == "" {
+		return
+	}
+	sort.SliceStable(ips, func(i, j int) bool {
+		return preferred(ips[i], family) && !preferred(ips[j], family)
+	})
+}
+
+func dialFamily(d *net.Dialer, family string) dialCtxFunc {
+	switch family {
+	case "ipv4", "ipv6":
+		suffix := family[len(family)-1:]
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if network == "tcp" {
+				network += suffix
+			}
+			return d.DialContext(ctx, network, addr)
+		}
+	case "prefer-ipv4", "prefer-ipv6":
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil || net.ParseIP(host) != nil {
+				return d.DialContext(ctx, network, addr)
+			}
+			ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+			if err != nil {
+				return nil, err
+			}
+			sortByFamily(ips, family)
+			var lastErr error
+			for _, ip := range ips {
+				c, err := d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+				if err == nil {
+					return c, nil
+				}
+				lastErr = err
+			}
+			return nil, lastErr
+		}
+	}
+	return d.DialContext
+}
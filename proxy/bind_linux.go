@@ -0,0 +1,20 @@
+package proxy
+
+import (
+	"syscall"
+)
+
+// bindToDevice binds sockets to the network interface by SO_BINDTODEVICE,
+// which requires CAP_NET_RAW.
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
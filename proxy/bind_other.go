@@ -0,0 +1,14 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"fmt"
+	"syscall"
+)
+
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return fmt.Errorf("uOptBindIface is only supported on Linux")
+	}
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zjx20/urlproxy/urlopts"
+)
+
+func TestApplyBind(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	u, _ := url.Parse("/?uOptBindIp=127.0.0.1,127.0.0.2&uOptIpFamily=ipv4")
+	_, opts := urlopts.Extract(u)
+	require.NoError(t, checkBind(opts))
+
+	seen := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		fn, identifier := applyBind(&net.Dialer{}, opts, false)
+		seen[identifier] = true
+		c, err := fn(context.Background(), "tcp", ln.Addr().String())
+		require.NoError(t, err)
+		local := c.LocalAddr().(*net.TCPAddr).IP.String()
+		assert.Contains(t, identifier, "[bind:"+local+"]")
+		assert.Contains(t, identifier, "[family:ipv4]")
+		c.Close()
+	}
+	assert.Len(t, seen, 2)
+
+	// peeking returns the next address without rotating
+	_, peeked := applyBind(&net.Dialer{}, opts, true)
+	_, again := applyBind(&net.Dialer{}, opts, true)
+	_, next := applyBind(&net.Dialer{}, opts, false)
+	assert.Equal(t, peeked, again)
+	assert.Equal(t, peeked, next)
+
+	u, _ = url.Parse("/?uOptBindIp=127.0.0.1,bad")
+	_, opts = urlopts.Extract(u)
+	assert.Error(t, checkBind(opts))
+	u, _ = url.Parse("/?uOptBindIface=urlproxy-none")
+	_, opts = urlopts.Extract(u)
+	assert.Error(t, checkBind(opts))
+	// cached
+	assert.Error(t, checkBind(opts))
+
+	// CONNECT requests are validated too
+	req := httptest.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+	rec := httptest.NewRecorder()
+	Handle(rec, req, opts)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
@@ -0,0 +1,296 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zjx20/urlproxy/admin"
+	"github.com/zjx20/urlproxy/logger"
+	"github.com/zjx20/urlproxy/urlopts"
+)
+
+var (
+	breakerFailures = flag.Int("breaker-failures", 5, "Consecutive failures of a target host to open its circuit breaker, 0 disables circuit breakers")
+	breakerCooldown = flag.Duration("breaker-cooldown", 30*time.Second, "How long an open circuit breaker rejects requests before letting a probe through")
+)
+
+var (
+	breakers = &breakerSet{m: map[breakerKey]*breaker{}}
+
+	headerBreaker = http.CanonicalHeaderKey("X-Urlproxy-Breaker")
+)
+
+type breakerState string
+
+const (
+	breakerClosed   breakerState = "closed"
+	breakerOpen     breakerState = "open"
+	breakerHalfOpen breakerState = "half-open"
+)
+
+// breakerKey identifies a breaker by the target host and the route to it,
+// i.e. the identifier of the dialer and the transport, so that a route
+// that doesn't work (e.g. a broken socks5 proxy) doesn't affect the others.
+type breakerKey struct {
+	host  string
+	route string
+}
+
+func (k breakerKey) String() string {
+	return k.host + k.route
+}
+
+// errBreakerOpen is returned for the requests rejected by an open circuit
+// breaker.
+type errBreakerOpen struct {
+	key   breakerKey
+	until time.Time
+}
+
+func (e *errBreakerOpen) Error() string {
+	return fmt.Sprintf("circuit breaker of %s is open", e.key)
+}
+
+// breaker is the circuit breaker of a target host. Only hosts with failures
+// have breakers, they are removed once closed.
+type breaker struct {
+	key      breakerKey
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool // a probe is in flight in the half-open state
+}
+
+type breakerSet struct {
+	mu sync.Mutex
+	m  map[breakerKey]*breaker
+}
+
+// allow tells whether a request to the host can be sent. In the half-open
+// state, only one probe is allowed at a time.
+func (bs *breakerSet) allow(key breakerKey) error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	b := bs.m[key]
+	if b == nil {
+		return nil
+	}
+	switch b.state {
+	case breakerOpen:
+		until := b.openedAt.Add(*breakerCooldown)
+		if time.Now().Before(until) {
+			return &errBreakerOpen{key: key, until: until}
+		}
+		logger.Infof("circuit breaker of %s is half-open", key)
+		b.state = breakerHalfOpen
+		b.probing = true
+	case breakerHalfOpen:
+		if b.probing {
+			return &errBreakerOpen{key: key, until: time.Now().Add(time.Second)}
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// isOpen tells whether a breaker of the host, through any route, rejects
+// requests, without changing its state.
+func (bs *breakerSet) isOpen(host string) bool {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	now := time.Now()
+	for key, b := range bs.m {
+		if key.host == host && b.state == breakerOpen &&
+			now.Before(b.openedAt.Add(*breakerCooldown)) {
+			return true
+		}
+	}
+	return false
+}
+
+// record updates the breaker by the result of a request.
+func (bs *breakerSet) record(key breakerKey, failed bool) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	b := bs.m[key]
+	if !failed {
+		if b != nil {
+			if b.state != breakerClosed {
+				logger.Infof("circuit breaker of %s is closed", key)
+			}
+			delete(bs.m, key)
+		}
+		return
+	}
+	if b == nil {
+		b = &breaker{key: key, state: breakerClosed}
+		bs.m[key] = b
+	}
+	b.failures++
+	b.probing = false
+	if b.state == breakerHalfOpen ||
+		(b.state == breakerClosed && b.failures >= *breakerFailures) {
+		logger.Warnf("circuit breaker of %s is open, failures: %d", key, b.failures)
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// release gives up the probe of the half-open state without a result,
+// e.g. the client has gone.
+func (bs *breakerSet) release(key breakerKey) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if b := bs.m[key]; b != nil {
+		b.probing = false
+	}
+}
+
+type breakerStats struct {
+	Host     string       `json:"host"`
+	Route    string       `json:"route,omitempty"`
+	State    breakerState `json:"state"`
+	Failures int          `json:"failures"`
+	OpenedAt *time.Time   `json:"openedAt,omitempty"`
+}
+
+func (bs *breakerSet) snapshot() []breakerStats {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	result := make([]breakerStats, 0, len(bs.m))
+	for _, b := range bs.m {
+		s := breakerStats{
+			Host:     b.key.host,
+			Route:    b.key.route,
+			State:    b.state,
+			Failures: b.failures,
+		}
+		if b.state != breakerClosed {
+			openedAt := b.openedAt
+			s.OpenedAt = &openedAt
+		}
+		result = append(result, s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Host+result[i].Route < result[j].Host+result[j].Route
+	})
+	return result
+}
+
+// guardedByBreaker tells whether the request is guarded by circuit
+// breakers.
+func guardedByBreaker(proxyReq *http.Request, opts *urlopts.Options) bool {
+	if *breakerFailures <= 0 {
+		return false
+	}
+	if bypass, _ := urlopts.OptBypassBreaker.ValueFrom(opts); bypass {
+		return false
+	}
+	return proxyReq.URL.Scheme == "http" || proxyReq.URL.Scheme == "https"
+}
+
+// breakerKeyOf returns the key of the breaker for the request sent by cli.
+func breakerKeyOf(cli *http.Client, proxyReq *http.Request) breakerKey {
+	key := breakerKey{host: proxyReq.URL.Host}
+	if pt, ok := cli.Transport.(*pooledTransport); ok {
+		key.route = pt.route
+	}
+	return key
+}
+
+// clientFailureOptions are the options that can make requests fail by
+// themselves, e.g. a tiny timeout or a bogus address.
+var clientFailureOptions = []interface{ Name() string }{
+	urlopts.OptTimeoutMs,
+	urlopts.OptConnectTimeoutMs,
+	urlopts.OptHeaderTimeoutMs,
+	urlopts.OptIp,
+	urlopts.OptSocks,
+	urlopts.OptDns,
+	urlopts.OptBindIp,
+	urlopts.OptBindIface,
+}
+
+// failureByClient tells whether a failure of the request may be caused by
+// the options chosen by the client rather than the upstream, such failures
+// are not counted. Options from the presets and signed urls are trusted.
+func failureByClient(opts *urlopts.Options) bool {
+	for _, id := range clientFailureOptions {
+		if opts.Untrusted(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamFailed tells whether the result of a request counts as a failure
+// of the upstream.
+func upstreamFailed(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// doGuardedRequest sends the request if the circuit breaker of the target
+// host allows, and records the result. A request exceeding its connect or
+// first byte timeout counts as a failure, unless the timeout is chosen by
+// the client, see failureByClient().
+func doGuardedRequest(cli *http.Client, proxyReq *http.Request, opts *urlopts.Options) (*http.Response, error) {
+	key := breakerKeyOf(cli, proxyReq)
+	if !guardedByBreaker(proxyReq, opts) {
+		if bypass, _ := urlopts.OptBypassBreaker.ValueFrom(opts); bypass {
+			// the result of a health probe still closes the breaker
+			resp, err := doTimedRequest(cli, proxyReq, opts)
+			if !upstreamFailed(resp, err) {
+				breakers.record(key, false)
+			}
+			return resp, err
+		}
+		return doTimedRequest(cli, proxyReq, opts)
+	}
+	if err := breakers.allow(key); err != nil {
+		return nil, err
+	}
+	resp, err := doTimedRequest(cli, proxyReq, opts)
+	failed := upstreamFailed(resp, err)
+	if (err != nil && errors.Is(proxyReq.Context().Err(), context.Canceled)) ||
+		(failed && failureByClient(opts)) {
+		// canceled by the client or the race mode, or failed by the options
+		// of the client
+		breakers.release(key)
+		return resp, err
+	}
+	breakers.record(key, failed)
+	return resp, err
+}
+
+// respondBreakerOpen responds 503 for the request rejected by an open
+// circuit breaker.
+func respondBreakerOpen(w http.ResponseWriter, e *errBreakerOpen) {
+	w.Header().Set(headerBreaker, "open")
+	retryAfter := int(time.Until(e.until)/time.Second) + 1
+	w.Header().Set("Retry-After", fmt.Sprint(retryAfter))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte(e.Error()))
+}
+
+// ServeBreakers lists the circuit breakers of the target hosts with
+// failures.
+func ServeBreakers(w http.ResponseWriter, req *http.Request) {
+	admin.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"failures": *breakerFailures,
+		"cooldown": breakerCooldown.String(),
+		"breakers": breakers.snapshot(),
+	})
+}
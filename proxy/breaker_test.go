@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zjx20/urlproxy/app/info"
+	"github.com/zjx20/urlproxy/urlopts"
+)
+
+func TestBreaker(t *testing.T) {
+	oldFailures, oldCooldown := *breakerFailures, *breakerCooldown
+	*breakerFailures, *breakerCooldown = 2, time.Minute
+	defer func() { *breakerFailures, *breakerCooldown = oldFailures, oldCooldown }()
+
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	host := server.Listener.Addr().String()
+	info.SetListenAddr(server.Listener.Addr())
+
+	serve := func(extra string) *httptest.ResponseRecorder {
+		u, _ := url.Parse("/" + host + "/?uOptRetriesNon2xx=5" + extra)
+		after, opts := urlopts.Extract(u)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.URL = &after
+		rec := httptest.NewRecorder()
+		Handle(rec, req, opts)
+		return rec
+	}
+
+	// the retries stop once the breaker is open
+	rec := serve("")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "open", rec.Header().Get(headerBreaker))
+	require.Len(t, breakers.snapshot(), 1)
+	assert.Equal(t, breakerOpen, breakers.snapshot()[0].State)
+
+	// health probes bypass the breaker, and close it on success
+	status = http.StatusOK
+	rec = serve("&uOptBypassBreaker=1")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, breakers.snapshot())
+
+	// a failed probe in the half-open state opens it again
+	*breakerCooldown = 50 * time.Millisecond
+	status = http.StatusBadGateway
+	serve("&uOptRetriesNon2xx=0")
+	serve("&uOptRetriesNon2xx=0")
+	assert.Equal(t, breakerOpen, breakers.snapshot()[0].State)
+	time.Sleep(60 * time.Millisecond)
+	rec = serve("&uOptRetriesNon2xx=0")
+	assert.Equal(t, http.StatusBadGateway, rec.Code)
+	assert.Empty(t, rec.Header().Get(headerBreaker))
+	assert.Equal(t, breakerOpen, breakers.snapshot()[0].State)
+
+	status = http.StatusOK
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, http.StatusOK, serve("").Code)
+	assert.Empty(t, breakers.snapshot())
+
+	// failures with the timeouts or routes chosen by the client don't count
+	status = http.StatusBadGateway
+	for i := 0; i < 3; i++ {
+		serve("&uOptRetriesNon2xx=0&uOptConnectTimeoutMs=1")
+	}
+	assert.Empty(t, breakers.snapshot())
+
+	// routes have their own breakers
+	serve("&uOptRetriesNon2xx=1&uOptHttpVersion=1.1")
+	require.Len(t, breakers.snapshot(), 1)
+	assert.Equal(t, "[http:1.1]", breakers.snapshot()[0].Route)
+	assert.Equal(t, breakerOpen, breakers.snapshot()[0].State)
+	status = http.StatusOK
+	assert.Equal(t, http.StatusOK, serve("").Code)
+	assert.Equal(t, "open", serve("&uOptHttpVersion=1.1").Header().Get(headerBreaker))
+	*breakerCooldown = 0
+	assert.Equal(t, http.StatusOK, serve("&uOptHttpVersion=1.1").Code)
+	assert.Empty(t, breakers.snapshot())
+}
@@ -0,0 +1,325 @@
+package proxy
+
+import (
+	"context"
+	"flag"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/zjx20/urlproxy/logger"
+	"github.com/zjx20/urlproxy/urlopts"
+)
+
+var (
+	coalesceDefault   = flag.Bool("coalesce", false, "Coalesce identical concurrent GET and HEAD requests into one upstream request, uOptCoalesce overrides it")
+	coalesceVary      = flag.String("coalesce-vary", "Accept,Accept-Language,Authorization,Cookie,If-Modified-Since,If-None-Match,Range", "Comma-separated request headers that must be identical for coalescing requests")
+	coalesceMaxBuffer = flag.Int("coalesce-max-buffer", 8<<20, "Max bytes of a coalesced response body buffered for late joiners, identical requests arriving after that go upstream on their own")
+)
+
+var (
+	flights = &flightGroup{m: map[string]*flight{}}
+
+	headerCoalesced = http.CanonicalHeaderKey("X-Urlproxy-Coalesced")
+)
+
+// flight is an upstream request shared by identical requests. The response
+// body is buffered from the beginning, so that requests joining later can
+// read it from the start. Once the body exceeds -coalesce-max-buffer, the
+// flight stops accepting joiners, and the bytes read by all bodies are
+// dropped.
+type flight struct {
+	key    string
+	cancel context.CancelFunc
+	ready  chan struct{} // closed when resp or err is set
+
+	resp *http.Response
+	err  error
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	refs     int  // waiters and bodies
+	closed   bool // no more joiners
+	data     []byte
+	base     int64 // offset of data[0] in the body
+	done     bool
+	readErr  error
+	bodies   map[*flightBody]bool
+	trailers http.Header
+}
+
+type flightGroup struct {
+	mu sync.Mutex
+	m  map[string]*flight // key => flight
+}
+
+// coalesceKey returns the key of identical requests, or "" if the request
+// can't be coalesced.
+func coalesceKey(req *http.Request, proxyReq *http.Request, opts *urlopts.Options) string {
+	enabled, ok := urlopts.OptCoalesce.ValueFrom(opts)
+	if !ok {
+		enabled = *coalesceDefault
+	}
+	if !enabled {
+		return ""
+	}
+	if proxyReq.Method != http.MethodGet && proxyReq.Method != http.MethodHead {
+		return ""
+	}
+	if req.ContentLength != 0 || len(req.TransferEncoding) > 0 {
+		return ""
+	}
+	// the target host is in the option path, and it may be picked from an
+	// upstream group for proxyReq
+	var b strings.Builder
+	b.WriteString(proxyReq.Method + "|" + req.URL.String() + "|" + urlopts.SortedOptionPath(opts))
+	b.WriteString(varyHeaders(proxyReq))
+	return b.String()
+}
+
+// varyHeaders returns the values of the -coalesce-vary headers of the
+// request, responses to requests differing in them are not interchangeable.
+func varyHeaders(proxyReq *http.Request) string {
+	var b strings.Builder
+	for _, k := range strings.Split(*coalesceVary, ",") {
+		k = http.CanonicalHeaderKey(strings.TrimSpace(k))
+		if k == "" {
+			continue
+		}
+		b.WriteString("|" + k + ":" + strings.Join(proxyReq.Header.Values(k), ","))
+	}
+	return b.String()
+}
+
+// join returns the flight of the key, a new flight is started if there is
+// no joinable one. leader tells whether the flight is started by the call.
+func (fg *flightGroup) join(key string, proxyReq *http.Request, opts *urlopts.Options) (f *flight, leader bool) {
+	fg.mu.Lock()
+	defer fg.mu.Unlock()
+	if f := fg.m[key]; f != nil {
+		f.mu.Lock()
+		joined := !f.closed && f.refs > 0
+		if joined {
+			f.refs++
+		}
+		f.mu.Unlock()
+		if joined {
+			return f, false
+		}
+	}
+	// the upstream request is not bound to the leader, which may leave
+	// before the others, but the deadline of uOptTimeoutMs is kept
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if deadline, ok := proxyReq.Context().Deadline(); ok {
+		ctx, cancel = context.WithDeadline(context.Background(), deadline)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	f = &flight{
+		key:    key,
+		cancel: cancel,
+		ready:  make(chan struct{}),
+		refs:   1,
+		bodies: map[*flightBody]bool{},
+	}
+	f.cond = sync.NewCond(&f.mu)
+	fg.m[key] = f
+	go fg.run(f, proxyReq.WithContext(ctx), opts)
+	return f, true
+}
+
+// remove stops the flight from accepting joiners.
+func (fg *flightGroup) remove(f *flight) {
+	fg.mu.Lock()
+	if fg.m[f.key] == f {
+		delete(fg.m, f.key)
+	}
+	fg.mu.Unlock()
+	f.mu.Lock()
+	f.closed = true
+	f.mu.Unlock()
+}
+
+// release drops a reference of the flight, the upstream request is canceled
+// if nobody is interested in it anymore.
+func (fg *flightGroup) release(f *flight) {
+	f.mu.Lock()
+	f.refs--
+	abandoned := f.refs == 0
+	f.cond.Broadcast()
+	f.mu.Unlock()
+	if abandoned {
+		fg.remove(f)
+		f.cancel()
+	}
+}
+
+func (fg *flightGroup) run(f *flight, proxyReq *http.Request, opts *urlopts.Options) {
+	defer f.cancel()
+	defer fg.remove(f)
+	resp, err := doRequest(proxyReq, opts)
+	if err == nil && resp.Body == nil {
+		resp.Body = http.NoBody
+	}
+	f.resp, f.err = resp, err
+	close(f.ready)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	limit := int64(*coalesceMaxBuffer)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		f.mu.Lock()
+		f.data = append(f.data, buf[:n]...)
+		if err != nil {
+			f.done = true
+			f.readErr = err
+			f.trailers = resp.Trailer.Clone()
+			f.cond.Broadcast()
+			f.mu.Unlock()
+			return
+		}
+		overflow := !f.closed && f.base+int64(len(f.data)) > limit
+		f.cond.Broadcast()
+		f.mu.Unlock()
+
+		if overflow {
+			logger.Debugf("coalesced response of %s exceeds %d bytes, stop joining",
+				proxyReq.URL.String(), limit)
+			fg.remove(f)
+		}
+
+		f.mu.Lock()
+		if f.closed {
+			f.trim()
+			// wait for the slowest body, so that the buffer is bounded
+			for int64(len(f.data)) >= limit && f.refs > 0 {
+				f.cond.Wait()
+				f.trim()
+			}
+		}
+		abandoned := f.refs == 0
+		f.mu.Unlock()
+		if abandoned {
+			return
+		}
+	}
+}
+
+// trim drops the bytes read by all bodies, the caller must hold f.mu.
+// Nothing is dropped while some waiters haven't got their bodies.
+func (f *flight) trim() {
+	if len(f.bodies) < f.refs {
+		return
+	}
+	lowest := f.base + int64(len(f.data))
+	for b := range f.bodies {
+		if b.off < lowest {
+			lowest = b.off
+		}
+	}
+	if lowest > f.base {
+		f.data = append([]byte(nil), f.data[lowest-f.base:]...)
+		f.base = lowest
+	}
+}
+
+// flightBody reads the shared response body of a flight.
+type flightBody struct {
+	fg     *flightGroup
+	f      *flight
+	resp   *http.Response
+	ctx    context.Context // of the client
+	off    int64
+	closed bool
+}
+
+func (b *flightBody) Read(p []byte) (int, error) {
+	f := b.f
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for !b.closed && !f.done && b.off >= f.base+int64(len(f.data)) && b.ctx.Err() == nil {
+		f.cond.Wait()
+	}
+	if b.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if err := b.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if b.off < f.base+int64(len(f.data)) {
+		n := copy(p, f.data[b.off-f.base:])
+		b.off += int64(n)
+		f.cond.Broadcast()
+		return n, nil
+	}
+	if f.readErr == io.EOF {
+		for k, v := range f.trailers {
+			b.resp.Trailer[k] = v
+		}
+	}
+	return 0, f.readErr
+}
+
+func (b *flightBody) Close() error {
+	f := b.f
+	f.mu.Lock()
+	if b.closed {
+		f.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	delete(f.bodies, b)
+	f.mu.Unlock()
+	b.fg.release(f)
+	return nil
+}
+
+// doCoalescedRequest is doRequest, but identical concurrent requests share
+// one upstream request if uOptCoalesce is on.
+func doCoalescedRequest(req *http.Request, proxyReq *http.Request, opts *urlopts.Options) (*http.Response, error) {
+	key := coalesceKey(req, proxyReq, opts)
+	if key == "" {
+		return doRequest(proxyReq, opts)
+	}
+	f, leader := flights.join(key, proxyReq, opts)
+	select {
+	case <-f.ready:
+	case <-proxyReq.Context().Done():
+		flights.release(f)
+		return nil, proxyReq.Context().Err()
+	}
+	if f.err != nil {
+		flights.release(f)
+		return nil, f.err
+	}
+	resp := *f.resp
+	resp.Header = f.resp.Header.Clone()
+	resp.Trailer = http.Header{}
+	resp.Request = proxyReq
+	if !leader {
+		logger.Debugf("coalesced request for %s", proxyReq.URL.String())
+		resp.Header.Set(headerCoalesced, "1")
+	}
+	// the body reads from the beginning, nothing has been trimmed since
+	// the waiter joined
+	body := &flightBody{fg: flights, f: f, resp: &resp, ctx: proxyReq.Context()}
+	f.mu.Lock()
+	f.bodies[body] = true
+	f.cond.Broadcast()
+	f.mu.Unlock()
+	// wake up the body waiting for data if its client has gone
+	go func() {
+		<-body.ctx.Done()
+		f.mu.Lock()
+		f.cond.Broadcast()
+		f.mu.Unlock()
+	}()
+	resp.Body = body
+	return &resp, nil
+}
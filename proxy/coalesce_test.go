@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zjx20/urlproxy/app/info"
+	"github.com/zjx20/urlproxy/urlopts"
+)
+
+func TestCoalesce(t *testing.T) {
+	var hits int32
+	release := make(chan struct{})
+	body := strings.Repeat("x", 100*1024)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		<-release
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+	info.SetListenAddr(server.Listener.Addr())
+
+	get := func() *httptest.ResponseRecorder {
+		u, _ := url.Parse("/" + server.Listener.Addr().String() + "/list.m3u8?uOptCoalesce=true")
+		after, opts := urlopts.Extract(u)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.URL = &after
+		rec := httptest.NewRecorder()
+		Handle(rec, req, opts)
+		return rec
+	}
+	waiters := func() int {
+		flights.mu.Lock()
+		defer flights.mu.Unlock()
+		for _, f := range flights.m {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			return f.refs
+		}
+		return 0
+	}
+
+	const n = 4
+	recs := make([]*httptest.ResponseRecorder, n)
+	wg := sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			recs[i] = get()
+		}(i)
+	}
+	for waiters() < n {
+		runtime.Gosched()
+	}
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+	coalesced := 0
+	for _, rec := range recs {
+		assert.Equal(t, body, rec.Body.String())
+		if rec.Header().Get(headerCoalesced) != "" {
+			coalesced++
+		}
+	}
+	assert.Equal(t, n-1, coalesced)
+
+	// finished requests are not shared
+	get()
+	get()
+	assert.Equal(t, int32(3), atomic.LoadInt32(&hits))
+}
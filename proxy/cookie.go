@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/zjx20/urlproxy/urlopts"
+)
+
+// With uOptRewriteCookies, cookies of all targets share the origin of
+// urlproxy, so their names are prefixed by a namespace of the target host,
+// e.g. "sid" from "example.com" is stored as "up<hash>_sid" in browsers.
+
+// cookieNamespace returns the namespace of the target in the options. It's
+// derived from uOptHost (or uOptUpstream) instead of the picked origin, so
+// that the origins of an upstream group share cookies.
+func cookieNamespace(opts *urlopts.Options) string {
+	target, _ := urlopts.OptHost.ValueFrom(opts)
+	if name, ok := urlopts.OptUpstream.ValueFrom(opts); ok {
+		target = "upstream:" + name
+	}
+	return "up" + md5Short(strings.ToLower(target))[:8] + "_"
+}
+
+// cookiePathPrefix returns the path of the request before the target path,
+// e.g. "/uOptScheme=https/example.com" of "/uOptScheme=https/example.com/a"
+// for the target path "/a". It's "" if the request isn't in the path style,
+// e.g. vhosts, token urls and short links.
+func cookiePathPrefix(req *http.Request) string {
+	orig, err := url.ParseRequestURI(req.RequestURI)
+	if err != nil {
+		return ""
+	}
+	path, target := orig.EscapedPath(), req.URL.EscapedPath()
+	if target == "" || !strings.HasSuffix(path, target) {
+		return ""
+	}
+	return path[:len(path)-len(target)]
+}
+
+func rewriteCookiesEnabled(req *http.Request, opts *urlopts.Options) bool {
+	if req.URL.Scheme != "" {
+		// cookies of regular proxy requests are handled by the client
+		return false
+	}
+	rewrite, _ := urlopts.OptRewriteCookies.ValueFrom(opts)
+	return rewrite
+}
+
+// rewriteCookies keeps the cookies in the namespace of the target, and
+// restores their names.
+func rewriteCookies(proxyReq *http.Request, req *http.Request, opts *urlopts.Options) {
+	if !rewriteCookiesEnabled(req, opts) {
+		return
+	}
+	ns := cookieNamespace(opts)
+	var kept []string
+	for _, c := range req.Cookies() {
+		if !strings.HasPrefix(c.Name, ns) {
+			continue
+		}
+		c.Name = c.Name[len(ns):]
+		kept = append(kept, c.String())
+	}
+	proxyReq.Header.Del("Cookie")
+	if len(kept) > 0 {
+		proxyReq.Header.Set("Cookie", strings.Join(kept, "; "))
+	}
+}
+
+// rewriteSetCookies namespaces the names of the cookies set by the target,
+// drops their Domain, and scopes their Path under the path of the request
+// before the target path, e.g. "/example.com/" for path-style urls.
+func rewriteSetCookies(resp *http.Response, req *http.Request, opts *urlopts.Options) {
+	if !rewriteCookiesEnabled(req, opts) {
+		return
+	}
+	cookies := resp.Cookies()
+	if len(cookies) == 0 {
+		return
+	}
+	ns := cookieNamespace(opts)
+	prefix := cookiePathPrefix(req)
+	resp.Header.Del("Set-Cookie")
+	for _, c := range cookies {
+		c.Name = ns + c.Name
+		c.Domain = ""
+		if prefix != "" {
+			if !strings.HasPrefix(c.Path, "/") {
+				c.Path = "/"
+			}
+			c.Path = prefix + c.Path
+		}
+		resp.Header.Add("Set-Cookie", c.String())
+	}
+}
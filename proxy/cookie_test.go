@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zjx20/urlproxy/urlopts"
+)
+
+func cookieRequest(requestURI string) (*http.Request, *urlopts.Options) {
+	u, _ := url.Parse(requestURI)
+	after, opts := urlopts.Extract(u)
+	return &http.Request{URL: &after, RequestURI: requestURI, Header: http.Header{}}, opts
+}
+
+func TestRewriteCookies(t *testing.T) {
+	req, opts := cookieRequest("/example.com/login?uOptRewriteCookies=1")
+	ns := cookieNamespace(opts)
+
+	resp := &http.Response{Header: http.Header{}}
+	resp.Header.Add("Set-Cookie", "sid=abc; Domain=example.com; Path=/app; HttpOnly")
+	resp.Header.Add("Set-Cookie", "lang=en")
+	rewriteSetCookies(resp, req, opts)
+	assert.Equal(t, []string{
+		ns + "sid=abc; Path=/example.com/app; HttpOnly",
+		ns + "lang=en; Path=/example.com/",
+	}, resp.Header["Set-Cookie"])
+
+	_, other := cookieRequest("/other.com/")
+	req.Header.Set("Cookie", ns+"sid=abc; other=1; "+cookieNamespace(other)+"sid=def")
+	proxyReq, err := prepareProxyRequest(req, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, "sid=abc", proxyReq.Header.Get("Cookie"))
+}
+
+func TestRewriteCookiesPath(t *testing.T) {
+	for requestURI, path := range map[string]string{
+		"/uOptScheme=https/example.com/a/login?uOptRewriteCookies=1":     "/uOptScheme=https/example.com/app",
+		"/uOptHost=example.com/uOptRewriteCookies=true/a/login":          "/uOptHost=example.com/uOptRewriteCookies=true/app",
+		"/a.com,b.com/uOptLbPolicy=hash/a/login?uOptRewriteCookies=true": "/a.com,b.com/uOptLbPolicy=hash/app",
+		"/uOptHost=example.com/uOptRewriteCookies=true/":                 "/uOptHost=example.com/uOptRewriteCookies=true/app",
+	} {
+		req, opts := cookieRequest(requestURI)
+		resp := &http.Response{Header: http.Header{"Set-Cookie": {"sid=abc; Path=/app"}}}
+		rewriteSetCookies(resp, req, opts)
+		assert.Equal(t, path, resp.Cookies()[0].Path, requestURI)
+	}
+
+	// an expanded short link isn't in the path style
+	req, opts := cookieRequest("/example.com/a?uOptRewriteCookies=1")
+	req.RequestURI = "/s/abc"
+	resp := &http.Response{Header: http.Header{"Set-Cookie": {"sid=abc; Path=/app"}}}
+	rewriteSetCookies(resp, req, opts)
+	assert.Equal(t, "/app", resp.Cookies()[0].Path)
+
+	// cookies are sent back to any origin of an inline group
+	req, opts = cookieRequest("/a.com,b.com/login?uOptRewriteCookies=1")
+	req.Header.Set("Cookie", cookieNamespace(opts)+"sid=abc")
+	for i := 0; i < 2; i++ {
+		proxyReq, err := prepareProxyRequest(req, opts)
+		assert.NoError(t, err)
+		assert.Equal(t, "sid=abc", proxyReq.Header.Get("Cookie"), proxyReq.URL.Host)
+	}
+}
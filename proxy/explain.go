@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/zjx20/urlproxy/urlopts"
+)
+
+// Plan describes how a request would be sent to the upstream.
+type Plan struct {
+	Target           string      `json:"target,omitempty"`
+	ForwardedHeaders http.Header `json:"forwardedHeaders,omitempty"`
+	DroppedHeaders   []string    `json:"droppedHeaders,omitempty"`
+	Dialer           []string    `json:"dialer"`
+	Error            string      `json:"error,omitempty"`
+}
+
+// Describe returns the plan for proxying the request, without sending it
+// or changing the states of the load balancing.
+func Describe(req *http.Request, opts *urlopts.Options) *Plan {
+	plan := &Plan{}
+	for k := range req.Header {
+		if donotForwardToReq[k] {
+			plan.DroppedHeaders = append(plan.DroppedHeaders, k)
+		}
+	}
+	sort.Strings(plan.DroppedHeaders)
+
+	proxyReq, err := prepareRequest(req, opts, true)
+	if err != nil {
+		plan.Error = err.Error()
+		return plan
+	}
+	plan.Target = proxyReq.URL.String()
+	plan.ForwardedHeaders = proxyReq.Header.Clone()
+	plan.ForwardedHeaders.Del(headerOrigin)
+
+	_, identifier := newDialer(proxyReq.URL.Host, opts, true)
+	plan.Dialer = dialerChain(identifier)
+	return plan
+}
+
+// dialerChain splits the identifier from getDialer(), e.g.
+// "[socks:127.0.0.1:1080][dns:8.8.8.8:53]", into the dialers in order.
+func dialerChain(identifier string) []string {
+	chain := []string{}
+	if !strings.HasPrefix(identifier, "[socks") {
+		chain = append(chain, "direct")
+	}
+	identifier = strings.TrimSuffix(strings.TrimPrefix(identifier, "["), "]")
+	if identifier != "" {
+		chain = append(chain, strings.Split(identifier, "][")...)
+	}
+	return chain
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/zjx20/urlproxy/urlopts"
+	"golang.org/x/net/http2"
+)
+
+// h2Schemes are proxied over HTTP/2 only, without falling back to
+// HTTP/1.1, e.g. for gRPC. The value is the scheme of the upstream url.
+var h2Schemes = map[string]string{
+	"h2c":   "http",
+	"grpc":  "http",
+	"h2":    "https",
+	"grpcs": "https",
+}
+
+// h2SchemeOf returns the HTTP/2 only scheme in the options, or "".
+// uOptHttpVersion=2 is h2, and uOptHttpVersion=h2c is h2c.
+func h2SchemeOf(opts *urlopts.Options) string {
+	scheme, _ := urlopts.OptScheme.ValueFrom(opts)
+	scheme = strings.ToLower(scheme)
+	if _, ok := h2Schemes[scheme]; ok {
+		return scheme
+	}
+	switch version, _ := urlopts.OptHttpVersion.ValueFrom(opts); version {
+	case "2":
+		return "h2"
+	case "h2c":
+		return "h2c"
+	}
+	return ""
+}
+
+// newH2Transport returns a HTTP/2 transport dialing by the dialer chain of
+// the options (socks, dns and ip). Without TLS, HTTP/2 is spoken with prior
+// knowledge (h2c).
+func newH2Transport(pt *pooledTransport, dialCtxFn dialCtxFunc, useTLS bool, conn connOptions) *http2.Transport {
+	// http2.Transport reads the idle timeout, keep-alive and timeouts from
+	// the http.Transport it's configured from
+	t1 := &http.Transport{
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	conn.apply(t1)
+	t2, err := http2.ConfigureTransports(t1)
+	if err != nil {
+		// never happens, t1 has no h2 registered
+		panic(err)
+	}
+	// the pool set by ConfigureTransports only takes the connections
+	// negotiated by t1, the default one dials by itself
+	t2.ConnPool = nil
+	dial := pt.dialContext(dialCtxFn)
+	t2.AllowHTTP = true
+	t2.DialTLSContext = func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil || !useTLS {
+			return conn, err
+		}
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+	return t2
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"flag"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zjx20/urlproxy/app/info"
+	"github.com/zjx20/urlproxy/urlopts"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestH2cStreaming(t *testing.T) {
+	// echoes every line as soon as it's received
+	upstream := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			w.WriteHeader(http.StatusHTTPVersionNotSupported)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		rd := bufio.NewReader(r.Body)
+		for {
+			line, err := rd.ReadString('\n')
+			if err != nil {
+				break
+			}
+			w.Write([]byte(line))
+			w.(http.Flusher).Flush()
+		}
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	}), &http2.Server{}))
+	defer upstream.Close()
+	info.SetListenAddr(upstream.Listener.Addr())
+	server := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		after, opts := urlopts.Extract(r.URL)
+		r.URL = &after
+		Handle(w, r, opts)
+	}), &http2.Server{}))
+	defer server.Close()
+
+	cli := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}}
+	pr, pw := io.Pipe()
+	resp, err := cli.Post(server.URL+"/uOptScheme=grpc/"+upstream.Listener.Addr().String()+"/echo.Echo/Stream",
+		"application/grpc", pr)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	rd := bufio.NewReader(resp.Body)
+	// full duplex: each line comes back before the request body ends
+	for _, msg := range []string{"ping 1\n", "ping 2\n"} {
+		pw.Write([]byte(msg))
+		line, err := rd.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, msg, line)
+	}
+	pw.Close()
+	rest, err := io.ReadAll(rd)
+	require.NoError(t, err)
+	assert.Empty(t, rest)
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+}
+
+func TestH2TransportIdleTimeout(t *testing.T) {
+	upstream := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}), &http2.Server{}))
+	defer upstream.Close()
+
+	defer flag.Set("idle-conn-timeout", idleConnTimeout.String())
+	flag.Set("idle-conn-timeout", "50ms")
+	pt := &pooledTransport{}
+	var d net.Dialer
+	conn, _ := connOptionsOf(&urlopts.Options{})
+	pt.transport = newH2Transport(pt, d.DialContext, false, conn)
+	defer pt.transport.CloseIdleConnections()
+	req, _ := http.NewRequest(http.MethodGet, upstream.URL, nil)
+	resp, err := pt.transport.RoundTrip(req)
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "HTTP/2.0", string(body))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&pt.openConns))
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt64(&pt.openConns) == 0
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/zjx20/urlproxy/logger"
+	"github.com/zjx20/urlproxy/urlopts"
+)
+
+var (
+	headerVarRegexp = regexp.MustCompile(`\$\{([a-zA-Z0-9_.-]+)\}`)
+)
+
+// headerVars resolves the variables in the values of uOptHeader and
+// uOptRespHeader, e.g. "${req.host}". Environment variables are only
+// resolved in the request headers from trusted sources, see set().
+type headerVars struct {
+	req    *http.Request  // the request to urlproxy
+	target *http.Request  // the upstream request
+	resp   *http.Response // the upstream response, nil for request headers
+}
+
+func envAllowed(name string) bool {
+	for _, pattern := range strings.Split(getSettings().headerEnvVars, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if ok, _ := path.Match(pattern, name); ok && pattern != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (hv *headerVars) lookup(name string, env bool) (string, bool) {
+	switch {
+	case name == "req.host":
+		return hv.req.Host, true
+	case name == "req.path":
+		return hv.req.URL.Path, true
+	case strings.HasPrefix(name, "req.header."):
+		return hv.req.Header.Get(name[len("req.header."):]), true
+	case name == "target.host":
+		return hv.target.URL.Host, true
+	case name == "target.scheme":
+		return hv.target.URL.Scheme, true
+	case strings.HasPrefix(name, "resp.header.") && hv.resp != nil:
+		return hv.resp.Header.Get(name[len("resp.header."):]), true
+	case strings.HasPrefix(name, "env."):
+		key := name[len("env."):]
+		if !env {
+			logger.Warnf("environment variable %s is not allowed from an untrusted source", key)
+			return "", true
+		}
+		if !envAllowed(key) {
+			logger.Warnf("environment variable %s is not allowed by -header-env-vars", key)
+			return "", true
+		}
+		return os.Getenv(key), true
+	}
+	return "", false
+}
+
+func (hv *headerVars) expand(s string, env bool) string {
+	if !strings.Contains(s, "${") {
+		return s
+	}
+	return headerVarRegexp.ReplaceAllStringFunc(s, func(m string) string {
+		if v, ok := hv.lookup(m[2:len(m)-1], env); ok {
+			return v
+		}
+		// unknown variables are kept as is
+		return m
+	})
+}
+
+// set replaces the headers in dst by the ones in src, with variables
+// expanded. Environment variables are only expanded in the headers present
+// in trusted, i.e. the ones from the presets or signed urls.
+func (hv *headerVars) set(dst http.Header, src http.Header, trusted http.Header) {
+	for k, values := range src {
+		_, env := trusted[k]
+		expanded := make([]string, 0, len(values))
+		for _, v := range values {
+			expanded = append(expanded, hv.expand(v, env))
+		}
+		dst[k] = expanded
+	}
+}
+
+// deleteHeaders deletes the headers matching any of the glob patterns,
+// e.g. "X-Forwarded-*". The match is case-insensitive.
+func deleteHeaders(header http.Header, patterns []string) {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		for k := range header {
+			if ok, _ := path.Match(pattern, strings.ToLower(k)); ok {
+				delete(header, k)
+			}
+		}
+	}
+}
+
+// deleteRequestHeaders is deleteHeaders for the upstream request. The http
+// client adds User-Agent if it's absent, so it's set to empty instead,
+// which means no User-Agent.
+func deleteRequestHeaders(header http.Header, opts *urlopts.Options) {
+	patterns, _ := urlopts.OptDelHeader.ValueFrom(opts)
+	if len(patterns) == 0 {
+		return
+	}
+	deleteHeaders(header, patterns)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), "user-agent"); ok {
+			header["User-Agent"] = []string{""}
+		}
+	}
+}
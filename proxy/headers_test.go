@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zjx20/urlproxy/urlopts"
+)
+
+func TestHeaderRewriting(t *testing.T) {
+	t.Setenv("URLPROXY_TEST_TOKEN", "secret")
+	t.Setenv("TEST_PRIVATE", "private")
+	defer func() { *headerEnvVars = "" }()
+	*headerEnvVars = "URLPROXY_*"
+	Reload()
+	defer Reload()
+	defaults, err := urlopts.ParseList([]string{
+		"uOptHeader=Authorization:Bearer%20${env.URLPROXY_TEST_TOKEN}",
+		"uOptHeader=X-Private:${env.TEST_PRIVATE}",
+	})
+	require.NoError(t, err)
+	urlopts.SetPresets(defaults, nil)
+	defer urlopts.SetPresets(nil, nil)
+	u, _ := url.Parse("/uOptScheme=https/example.com/get?" +
+		"uOptHeader=X-Token:${env.URLPROXY_TEST_TOKEN}&" +
+		"uOptRespHeader=X-Token:${env.URLPROXY_TEST_TOKEN}&" +
+		"uOptHeader=X-Host:${req.host}-${target.host}-${unknown}&" +
+		"uOptDelHeader=x-forwarded-*,Via,X-Urlproxy-Origin,User-Agent")
+	after, opts := urlopts.Extract(u)
+	require.NoError(t, urlopts.ApplyPresets(opts))
+	req := &http.Request{URL: &after, Host: "proxy.local", Header: http.Header{
+		"Via":               {"1.1 cdn"},
+		"X-Forwarded-For":   {"1.2.3.4"},
+		"X-Forwarded-Proto": {"https"},
+		"Accept":            {"*/*"},
+	}}
+	proxyReq, err := prepareProxyRequest(req, opts)
+	require.NoError(t, err)
+	assert.Equal(t, http.Header{
+		"Accept":        {"*/*"},
+		"Authorization": {"Bearer secret"},
+		"X-Private":     {""},
+		"X-Token":       {""},
+		"X-Host":        {"proxy.local-example.com-${unknown}"},
+		"User-Agent":    {""},
+	}, proxyReq.Header)
+
+	resp := &http.Response{Header: http.Header{"Server": {"nginx"}, "X-Powered-By": {"php"}}}
+	deleteHeaders(resp.Header, []string{"x-powered-*"})
+	assert.Equal(t, http.Header{"Server": {"nginx"}}, resp.Header)
+	vars := &headerVars{req: req, target: proxyReq, resp: resp}
+	assert.Equal(t, "from nginx", vars.expand("from ${resp.header.server}", false))
+	respHeaders, _ := urlopts.OptRespHeader.ValueFrom(opts)
+	vars.set(resp.Header, respHeaders, nil)
+	assert.Equal(t, "", resp.Header.Get("X-Token"))
+
+	// all the options of a signed url are trusted
+	_, opts = urlopts.Extract(u)
+	opts.Trust()
+	proxyReq, err = prepareProxyRequest(req, opts)
+	require.NoError(t, err)
+	assert.Equal(t, "secret", proxyReq.Header.Get("X-Token"))
+}
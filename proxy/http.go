@@ -5,6 +5,7 @@ import (
 	"context"
 	"crypto"
 	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -14,11 +15,17 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/zjx20/urlproxy/app/info"
+	"github.com/zjx20/urlproxy/cors"
+	"github.com/zjx20/urlproxy/inspector"
 	"github.com/zjx20/urlproxy/logger"
+	"github.com/zjx20/urlproxy/record"
+	"github.com/zjx20/urlproxy/reloaded"
+	"github.com/zjx20/urlproxy/session"
 	"github.com/zjx20/urlproxy/tpl"
 	"github.com/zjx20/urlproxy/urlopts"
 	"golang.org/x/net/proxy"
@@ -30,6 +37,8 @@ var (
 	fileRoot   = flag.String("file-root", "", "Root path for the file scheme")
 	tplRoot    = flag.String("tpl-root", "", "Root path for the tpl scheme")
 	enablePipe = flag.Bool("enable-uoptpipe", false, "Enable uOptPipe")
+
+	headerEnvVars = flag.String("header-env-vars", "", "Comma-separated globs of environment variables that can be referenced by ${env.NAME} in uOptHeader from the presets or signed urls")
 )
 
 const (
@@ -56,10 +65,46 @@ var (
 )
 
 var (
-	instUUID   = uuid.NewString()
-	clientPool = sync.Map{}
+	instUUID = uuid.NewString()
+	current  atomic.Value // *settings
 )
 
+// settings holds the flags that can be changed at runtime by Reload().
+type settings struct {
+	socks         string
+	socksUds      string
+	fileRoot      string
+	tplRoot       string
+	headerEnvVars string
+}
+
+func loadSettings() *settings {
+	return &settings{
+		socks:         reloaded.String("socks"),
+		socksUds:      reloaded.String("socks-uds"),
+		fileRoot:      reloaded.String("file-root"),
+		tplRoot:       reloaded.String("tpl-root"),
+		headerEnvVars: reloaded.String("header-env-vars"),
+	}
+}
+
+func getSettings() *settings {
+	if s, ok := current.Load().(*settings); ok {
+		return s
+	}
+	s := loadSettings()
+	current.Store(s)
+	return s
+}
+
+// Reload applies the latest values of the reloadable flags. Pooled
+// transports are closed because their dialers and protocols are built
+// from the previous values.
+func Reload() {
+	current.Store(loadSettings())
+	transports.purge()
+}
+
 type connEx struct {
 	*net.TCPConn
 	bufrd *bufio.Reader
@@ -79,7 +124,19 @@ type dialer interface {
 
 type dialCtxFunc func(ctx context.Context, network, addr string) (c net.Conn, err error)
 
-func getResolvedAddr(ctx context.Context, dns string, addr string) string {
+// ctxDialer adapts dialCtxFunc to proxy.Dialer, e.g. for dialing to the
+// socks5 proxy.
+type ctxDialer dialCtxFunc
+
+func (f ctxDialer) Dial(network, addr string) (net.Conn, error) {
+	return f(context.Background(), network, addr)
+}
+
+func (f ctxDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+func getResolvedAddr(ctx context.Context, dns string, addr string, family string) string {
 	host, port, err := net.SplitHostPort(addr)
 	if err != nil {
 		logger.Errorf("bad addr %s", addr)
@@ -98,44 +155,64 @@ func getResolvedAddr(ctx context.Context, dns string, addr string) string {
 	if err != nil {
 		logger.Errorf("resolve via custom DNS(%s) failed, err: %s", dns, err)
 	} else {
-		if len(addrs) == 0 {
+		var ips []net.IP
+		for _, a := range addrs {
+			if ip := net.ParseIP(a); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+		sortByFamily(ips, family)
+		if len(ips) == 0 {
 			logger.Errorf("resolve result for host(%s) is empty", host)
 		} else {
 			logger.Debugf("resolve results for host(%s): %q", host, addrs)
-			return net.JoinHostPort(addrs[0], port)
+			return net.JoinHostPort(ips[0].String(), port)
 		}
 	}
 	return addr
 }
 
 func getDialer(host string, opts *urlopts.Options) (dialCtxFunc, string) {
+	return newDialer(host, opts, false)
+}
+
+// newDialer builds the dialer chain for the options, and returns its
+// identifier. With peek, the source address of uOptBindIp is not rotated.
+func newDialer(host string, opts *urlopts.Options, peek bool) (dialCtxFunc, string) {
 	var identifier string
 
+	d := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	// the source address and the interface also apply to the connection
+	// to the socks5 proxy
+	directFn, bindIdentifier := applyBind(d, opts, peek)
+
 	var pd proxy.Dialer
 	if socksAddr, ok := urlopts.OptSocks.ValueFrom(opts); ok {
 		if socksAddr == "" || socksAddr == "off" {
 			// socksAddr == "" or "off" means user wants to disable socks proxying
 		} else {
 			identifier += "[socks:" + socksAddr + "]"
-			pd, _ = proxy.SOCKS5("tcp", socksAddr, nil, nil)
+			pd, _ = proxy.SOCKS5("tcp", socksAddr, nil, ctxDialer(directFn))
 		}
 	} else {
-		if *socks != "" {
-			identifier += "[socks:" + *socks + "]"
-			pd, _ = proxy.SOCKS5("tcp", *socks, nil, nil)
-		} else if *socksUds != "" {
-			identifier += "[socks-uds:" + *socksUds + "]"
-			pd, _ = proxy.SOCKS5("unix", *socksUds, nil, nil)
+		s := getSettings()
+		if s.socks != "" {
+			identifier += "[socks:" + s.socks + "]"
+			pd, _ = proxy.SOCKS5("tcp", s.socks, nil, ctxDialer(directFn))
+		} else if s.socksUds != "" {
+			identifier += "[socks-uds:" + s.socksUds + "]"
+			pd, _ = proxy.SOCKS5("unix", s.socksUds, nil, nil)
 		}
 	}
 
+	identifier += bindIdentifier
+
 	var fn dialCtxFunc
 	if pd == nil {
-		d := &net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}
-		fn = d.DialContext
+		fn = directFn
 	} else {
 		fn = pd.(dialer).DialContext
 	}
@@ -144,7 +221,8 @@ func getDialer(host string, opts *urlopts.Options) (dialCtxFunc, string) {
 		identifier += "[dns:" + dns + "]"
 		prevFn := fn
 		fn = func(ctx context.Context, network, addr string) (c net.Conn, err error) {
-			finalAddr := getResolvedAddr(ctx, dns, addr)
+			family, _ := urlopts.OptIpFamily.ValueFrom(opts)
+			finalAddr := getResolvedAddr(ctx, dns, addr, family)
 			return prevFn(ctx, network, finalAddr)
 		}
 	}
@@ -173,43 +251,85 @@ func tplExtraValues() map[string]interface{} {
 	}
 }
 
-func getHttpCli(host string, opts *urlopts.Options, reusable bool) *http.Client {
+// getHttpCli returns a pooled client for the host and options. Requests
+// issued in race mode use different slots, so that they don't share
+// connections with each other. With uOptSession, the returned client
+// carries the cookie jar of the session.
+func getHttpCli(host string, opts *urlopts.Options, slot int) *http.Client {
 	dialCtxFn, identifier := getDialer(host, opts)
-	if cli, ok := clientPool.Load(identifier); ok && reusable {
-		return cli.(*http.Client)
-	}
-	// same as http.DefaultTransport
-	transport := &http.Transport{
-		DialContext:           dialCtxFn,
-		ForceAttemptHTTP2:     true,
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-	}
-	if *fileRoot != "" {
-		transport.RegisterProtocol("file", http.NewFileTransport(http.Dir(*fileRoot)))
-	}
-	var tplFs http.FileSystem
-	if *tplRoot != "" {
-		tplFs = http.Dir(*tplRoot)
-	}
-	transport.RegisterProtocol("tpl", tpl.NewTplTransport(tplFs, tplExtraValues()))
-	cli := &http.Client{
-		Transport: transport,
-		// no redirect
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
-	}
-	if reusable {
-		clientPool.Store(identifier, cli)
+	h2 := h2SchemeOf(opts)
+	conn, connIdentifier := connOptionsOf(opts)
+	if h2 != "" {
+		identifier += "[" + h2 + "]"
+	}
+	identifier += connIdentifier
+	route := identifier
+	if slot > 0 {
+		identifier += fmt.Sprintf("[race:%d]", slot)
+	}
+	pt := transports.get(identifier, func() *pooledTransport {
+		pt := &pooledTransport{
+			id:      identifier,
+			route:   route,
+			created: time.Now(),
+		}
+		if h2 != "" {
+			pt.transport = newH2Transport(pt, dialCtxFn, h2Schemes[h2] == "https", conn)
+			pt.rt = record.Wrap(pt.transport)
+			pt.cli = &http.Client{
+				Transport: pt,
+				CheckRedirect: func(req *http.Request, via []*http.Request) error {
+					return http.ErrUseLastResponse
+				},
+			}
+			return pt
+		}
+		// same as http.DefaultTransport
+		transport := &http.Transport{
+			DialContext:           pt.dialContext(dialCtxFn),
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          *maxIdleConns,
+			MaxIdleConnsPerHost:   *maxIdleConnsPerHost,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		}
+		conn.apply(transport)
+		s := getSettings()
+		if s.fileRoot != "" {
+			transport.RegisterProtocol("file", http.NewFileTransport(http.Dir(s.fileRoot)))
+		}
+		var tplFs http.FileSystem
+		if s.tplRoot != "" {
+			tplFs = http.Dir(s.tplRoot)
+		}
+		transport.RegisterProtocol("tpl", tpl.NewTplTransport(tplFs, tplExtraValues()))
+		pt.transport = transport
+		pt.rt = record.Wrap(transport)
+		pt.cli = &http.Client{
+			Transport: pt,
+			// no redirect
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		return pt
+	})
+	if name, ok := urlopts.OptSession.ValueFrom(opts); ok {
+		if jar, err := session.Get(name); err == nil {
+			cli := *pt.cli
+			cli.Jar = jar
+			return &cli
+		}
 	}
-	return cli
+	return pt.cli
 }
 
-func forward(from, to *connEx, wg *sync.WaitGroup) {
-	io.Copy(to, from)
+func forward(from, to *connEx, wg *sync.WaitGroup, feed func()) {
+	if feed != nil {
+		io.Copy(to, &progressReader{r: from, feed: feed})
+	} else {
+		io.Copy(to, from)
+	}
 	from.CloseRead()
 	to.CloseWrite()
 	wg.Done()
@@ -233,7 +353,13 @@ func md5Short(s string) string {
 	return hex.EncodeToString(hash[:8])
 }
 
-func prepareProxyRequest(req *http.Request, opts *urlopts.Options) (proxyReq *http.Request, err error) {
+func prepareProxyRequest(req *http.Request, opts *urlopts.Options) (*http.Request, error) {
+	return prepareRequest(req, opts, false)
+}
+
+// prepareRequest builds the upstream request. With peek, an origin of the
+// upstream group is chosen without advancing the round-robin.
+func prepareRequest(req *http.Request, opts *urlopts.Options, peek bool) (proxyReq *http.Request, err error) {
 	reqSign := instUUID + "|" + req.URL.String() + "|" + md5Short(urlopts.SortedOptionPath(opts))
 	for _, origin := range req.Header[headerOrigin] {
 		if origin == reqSign {
@@ -241,6 +367,13 @@ func prepareProxyRequest(req *http.Request, opts *urlopts.Options) (proxyReq *ht
 			return
 		}
 	}
+	if name, ok := urlopts.OptSession.ValueFrom(opts); ok && !session.ValidName(name) {
+		err = fmt.Errorf("bad session name %s", name)
+		return
+	}
+	if err = checkBind(opts); err != nil {
+		return
+	}
 	proxyReqUrl := *req.URL
 
 	if proxyReqUrl.Scheme != "" {
@@ -252,14 +385,27 @@ func prepareProxyRequest(req *http.Request, opts *urlopts.Options) (proxyReq *ht
 			proxyReqUrl.Scheme = strings.ToLower(scheme)
 		}
 		// update the host
-		if proxyReqUrl.Scheme == "http" || proxyReqUrl.Scheme == "https" {
-			if host, ok := urlopts.OptHost.ValueFrom(opts); ok {
+		if urlopts.HasHost(proxyReqUrl.Scheme) {
+			group, groupErr := upstreamOf(opts)
+			if groupErr != nil {
+				err = groupErr
+				return
+			}
+			if group != nil {
+				proxyReqUrl.Host = group.pick(proxyReqUrl.Path, nil, peek).host
+			} else if host, ok := urlopts.OptHost.ValueFrom(opts); ok {
 				proxyReqUrl.Host = host
 			} else {
 				err = fmt.Errorf("OptHost not exists")
 				return
 			}
 		}
+		if underlying, ok := h2Schemes[proxyReqUrl.Scheme]; ok {
+			proxyReqUrl.Scheme = underlying
+		}
+	}
+	if err = checkHttpVersion(proxyReqUrl.Scheme, opts); err != nil {
+		return
 	}
 
 	if query, exists := urlopts.OptQueryParams.ValueFrom(opts); exists {
@@ -284,14 +430,19 @@ func prepareProxyRequest(req *http.Request, opts *urlopts.Options) (proxyReq *ht
 		proxyReq.Header[k] = append(proxyReq.Header[k], req.Header[k]...)
 	}
 
+	rewriteCookies(proxyReq, req, opts)
+	if cors.Enabled(opts) && req.URL.Scheme == "" {
+		cors.RewriteRequest(proxyReq, req)
+	}
+
 	// add origin header to break recursive requests
 	proxyReq.Header.Add(headerOrigin, reqSign)
 
 	// add custom headers
 	headers, _ := urlopts.OptHeader.ValueFrom(opts)
-	for key, values := range headers {
-		proxyReq.Header[key] = values
-	}
+	vars := &headerVars{req: req, target: proxyReq}
+	vars.set(proxyReq.Header, headers, opts.TrustedHeader(urlopts.OptHeader))
+	deleteRequestHeaders(proxyReq.Header, opts)
 
 	logger.Debugf("proxyReq: %+v, urlopts: %s", proxyReq, opts.String())
 
@@ -312,7 +463,7 @@ func doRequest(proxyReq *http.Request, opts *urlopts.Options) (*http.Response, e
 		ch := make(chan result, parallelism)
 		var cancels []context.CancelFunc
 		for i := int64(0); i < parallelism; i++ {
-			cli := getHttpCli(proxyReq.Host, opts, false)
+			cli := getHttpCli(proxyReq.Host, opts, int(i))
 			ctx, cancel := context.WithCancel(proxyReq.Context())
 			req := proxyReq.WithContext(ctx)
 			cancels = append(cancels, cancel)
@@ -361,7 +512,7 @@ func doRequest(proxyReq *http.Request, opts *urlopts.Options) (*http.Response, e
 		}
 		return lastResp, lastErr
 	} else {
-		cli := getHttpCli(proxyReq.Host, opts, true)
+		cli := getHttpCli(proxyReq.Host, opts, 0)
 		return doRequestSerial(cli, proxyReq, opts)
 	}
 }
@@ -370,6 +521,10 @@ func doRequestSerial(cli *http.Client, proxyReq *http.Request, opts *urlopts.Opt
 	retriesNon2xx, _ := urlopts.OptRetriesNon2xx.ValueFrom(opts)
 	retriesError, _ := urlopts.OptRetriesError.ValueFrom(opts)
 
+	// retries move to the next origin of the upstream group
+	group, _ := upstreamOf(opts)
+	tried := map[string]bool{proxyReq.URL.Host: true}
+
 	const maxRetryDelay = time.Second
 	retryDelay := 100 * time.Millisecond
 	raiseRetryDelay := func() {
@@ -386,15 +541,19 @@ func doRequestSerial(cli *http.Client, proxyReq *http.Request, opts *urlopts.Opt
 			proxyReq.URL.RawQuery = query.Encode()
 		}
 
-		resp, err := cli.Do(proxyReq)
+		resp, err := doOriginRequest(group, cli, proxyReq, opts)
 		if err != nil {
 			logger.Errorf("do request failed, url: %s, err: %s", proxyReq.URL.String(), err)
-			if retriesError == 0 {
+			var openErr *errBreakerOpen
+			if retriesError == 0 || (errors.As(err, &openErr) && group == nil) {
 				return nil, err
 			}
 			logger.Debugf("url: %s, err: %s. retry for errors, remaining retries: %d",
 				proxyReq.URL.String(), err, retriesError)
 			retriesError--
+			if group != nil {
+				moveToNextOrigin(group, proxyReq, tried)
+			}
 			time.Sleep(retryDelay)
 			raiseRetryDelay()
 			continue
@@ -418,6 +577,9 @@ func doRequestSerial(cli *http.Client, proxyReq *http.Request, opts *urlopts.Opt
 			}
 			resp.Body.Close()
 			retriesNon2xx--
+			if group != nil {
+				moveToNextOrigin(group, proxyReq, tried)
+			}
 			time.Sleep(retryDelay)
 			raiseRetryDelay()
 			continue
@@ -434,34 +596,70 @@ func writeRespHeader(w http.ResponseWriter, header http.Header) {
 	}
 }
 
+// ForwardResponse writes the response to the client. Streaming responses
+// are flushed as they arrive, and trailers are sent after the body.
 func ForwardResponse(w http.ResponseWriter, proxyResp *http.Response) {
+	forwardResponse(w, proxyResp, nil)
+}
+
+func forwardResponse(w http.ResponseWriter, proxyResp *http.Response, opts *urlopts.Options) {
 	writeRespHeader(w, proxyResp.Header)
 	w.WriteHeader(proxyResp.StatusCode)
-	_, err := io.Copy(w, proxyResp.Body)
+	dst, stop := streamWriter(w, proxyResp, opts)
+	_, err := io.Copy(dst, proxyResp.Body)
+	stop()
 	proxyResp.Body.Close()
 	if err != nil {
-		logger.Debugf("ForwardResponse error: %s", err)
+		var timeoutErr *errTimeout
+		if errors.As(err, &timeoutErr) {
+			logger.Warnf("ForwardResponse error: %s", err)
+		} else {
+			logger.Debugf("ForwardResponse error: %s", err)
+		}
 		return
 	}
-	for k := range proxyResp.Trailer {
-		w.Header().Set(k, proxyResp.Trailer.Get(k))
+	// the keys of trailers may be unknown before the body is read, so
+	// they are not declared by the Trailer header
+	for k, v := range proxyResp.Trailer {
+		w.Header()[http.TrailerPrefix+k] = v
 	}
 }
 
-func handleConnectMethod(w http.ResponseWriter, req *http.Request) {
-	// there is no parameter or path for CONNECT request,
-	// so empty options just fine.
-	opts := urlopts.Options{}
-	dialCtxFn, _ := getDialer(req.Host, &opts)
-	conn, err := dialCtxFn(req.Context(), "tcp", req.URL.Host)
+func handleConnectMethod(w http.ResponseWriter, req *http.Request, opts *urlopts.Options) {
+	// there is no parameter or path for CONNECT request, options can only
+	// come from the X-Urlproxy-Opt-* headers or the config file.
+	if err := checkBind(opts); err != nil {
+		logger.Errorf("connect to %s failed, err: %s", req.URL.Host, err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	dialCtxFn, _ := getDialer(req.Host, opts)
+	connect, _, idle := timeoutsOf(opts)
+	ctx := withConnectTimeout(req.Context(), connect)
+	conn, err := dialWithTimeout(ctx, dialCtxFn, "tcp", req.URL.Host)
 	if err != nil {
 		logger.Errorf("dial to %s failed, err: %s", req.URL.Host, err)
+		var timeoutErr *errTimeout
+		if errors.As(err, &timeoutErr) {
+			respondTimeout(w, timeoutErr)
+			return
+		}
 		w.WriteHeader(http.StatusBadGateway)
 		w.Write([]byte(err.Error()))
 		return
 	}
 	defer conn.Close()
-	inConn, bufrw, err := w.(http.Hijacker).Hijack()
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		// e.g. CONNECT over HTTP/2
+		err = fmt.Errorf("hijacking is not supported")
+		logger.Errorf("hijack failed, err: %s", err)
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	inConn, bufrw, err := hijacker.Hijack()
 	if err != nil {
 		logger.Errorf("hijack failed, err: %s", err)
 		w.WriteHeader(http.StatusBadGateway)
@@ -487,10 +685,22 @@ func handleConnectMethod(w http.ResponseWriter, req *http.Request) {
 
 	conn1 := &connEx{TCPConn: conn.(*net.TCPConn)}
 	conn2 := &connEx{TCPConn: inConn.(*net.TCPConn), bufrd: bufrw.Reader}
+	// the tunnel is closed if neither direction makes progress for the
+	// idle timeout
+	var feed func()
+	if idle > 0 {
+		timer := time.AfterFunc(idle, func() {
+			logger.Warnf("tunnel to %s: %s", req.URL.Host, &errTimeout{kind: timeoutIdle, after: idle})
+			conn.Close()
+			inConn.Close()
+		})
+		defer timer.Stop()
+		feed = func() { timer.Reset(idle) }
+	}
 	wg := &sync.WaitGroup{}
 	wg.Add(2)
-	go forward(conn1, conn2, wg)
-	go forward(conn2, conn1, wg)
+	go forward(conn1, conn2, wg, feed)
+	go forward(conn2, conn1, wg, feed)
 	wg.Wait()
 }
 
@@ -512,13 +722,15 @@ func rewriteLocation(resp *http.Response, req *http.Request, opts *urlopts.Optio
 
 func Handle(w http.ResponseWriter, req *http.Request, opts *urlopts.Options) bool {
 	if req.Method == http.MethodConnect {
-		handleConnectMethod(w, req)
+		handleConnectMethod(w, req, opts)
 		return true
 	}
 
+	tx := inspector.Begin(req, opts)
 	proxyReq, err := prepareProxyRequest(req, opts)
 	if err != nil {
 		logger.Errorf("prepare proxy request failed, err: %s", err)
+		tx.Fail(err)
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(err.Error()))
 		return true
@@ -531,34 +743,63 @@ func Handle(w http.ResponseWriter, req *http.Request, opts *urlopts.Options) boo
 		defer cancel()
 	}
 
-	proxyResp, err := doRequest(proxyReq, opts)
+	tx.SetUpstream(proxyReq)
+	proxyResp, err := doCoalescedRequest(req, proxyReq, opts)
+	proxyResp, err = withStaleIfError(req, proxyReq, proxyResp, err, opts)
 	if err != nil {
+		tx.Fail(err)
+		var openErr *errBreakerOpen
+		if errors.As(err, &openErr) {
+			respondBreakerOpen(w, openErr)
+			return true
+		}
+		var timeoutErr *errTimeout
+		if errors.As(err, &timeoutErr) {
+			respondTimeout(w, timeoutErr)
+			return true
+		}
 		w.WriteHeader(http.StatusBadGateway)
 		w.Write([]byte(err.Error()))
 		return true
 	}
+	tx.SetResponse(proxyResp)
 	logger.Debugf("proxyResp for %s, StatusCode: %d", proxyReq.URL.String(), proxyResp.StatusCode)
 	rewriteLocation(proxyResp, req, opts)
+	rewriteSetCookies(proxyResp, req, opts)
+	if proxyResp.Header == nil {
+		proxyResp.Header = make(http.Header)
+	}
+	if (proxyReq.URL.Scheme == "http" || proxyReq.URL.Scheme == "https") &&
+		proxyResp.Header.Get(headerStale) == "" {
+		// the protocol actually negotiated with the target
+		proxyResp.Header.Set(headerUpstreamProto, proxyResp.Proto)
+	}
 	extraRespHeader, _ := urlopts.OptRespHeader.ValueFrom(opts)
 	if len(extraRespHeader) > 0 {
-		if proxyResp.Header == nil {
-			proxyResp.Header = make(http.Header)
-		}
+		vars := &headerVars{req: req, target: proxyReq, resp: proxyResp}
+		expanded := http.Header{}
+		// environment variables are never exposed to the client
+		vars.set(expanded, extraRespHeader, nil)
+		extraRespHeader = expanded
 		for k, v := range extraRespHeader {
 			proxyResp.Header[k] = v
 		}
 	}
+	if patterns, _ := urlopts.OptDelRespHeader.ValueFrom(opts); len(patterns) > 0 {
+		deleteHeaders(proxyResp.Header, patterns)
+	}
 	if *enablePipe {
 		if proxyResp.StatusCode >= 200 && proxyResp.StatusCode < 300 {
 			if cmd, exists := urlopts.OptPipe.ValueFrom(opts); exists {
 				// headers from proxyResp may not suitable for the processed
 				// data, so we only write headers from uOptRespHeader.
 				writeRespHeader(w, extraRespHeader)
+				defer proxyResp.Body.Close()
 				pipe(w, req, proxyResp, cmd)
 				return true
 			}
 		}
 	}
-	ForwardResponse(w, proxyResp)
+	forwardResponse(w, proxyResp, opts)
 	return true
 }
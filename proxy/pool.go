@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"flag"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zjx20/urlproxy/admin"
+	"github.com/zjx20/urlproxy/logger"
+)
+
+var (
+	poolSize            = flag.Int("transport-pool-size", 64, "Max number of upstream transports, the least recently used one will be closed if exceeded")
+	maxIdleConns        = flag.Int("max-idle-conns", 100, "Max idle connections of each upstream transport")
+	maxIdleConnsPerHost = flag.Int("max-idle-conns-per-host", 0, "Max idle connections per host of each upstream transport, 0 means using the default value (2)")
+	maxConnsPerHost     = flag.Int("max-conns-per-host", 0, "Max connections per host of each upstream transport, 0 means no limit")
+	idleConnTimeout     = flag.Duration("idle-conn-timeout", 90*time.Second, "Idle connections of upstream transports will be closed after this duration")
+)
+
+var (
+	transports = newTransportPool()
+)
+
+// countedConn reports to its transport when it's closed.
+type countedConn struct {
+	net.Conn
+	once sync.Once
+	pt   *pooledTransport
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() {
+		atomic.AddInt64(&c.pt.openConns, -1)
+	})
+	return c.Conn.Close()
+}
+
+// trackedBody marks the end of a request when the response body is closed.
+type trackedBody struct {
+	io.ReadCloser
+	once sync.Once
+	pt   *pooledTransport
+}
+
+func (b *trackedBody) Close() error {
+	b.once.Do(func() {
+		atomic.AddInt64(&b.pt.inflight, -1)
+	})
+	return b.ReadCloser.Close()
+}
+
+// transport is *http.Transport, or *http2.Transport for the HTTP/2 only
+// schemes.
+type transport interface {
+	http.RoundTripper
+	CloseIdleConnections()
+}
+
+type pooledTransport struct {
+	id        string
+	route     string // id without the race slot, see getHttpCli()
+	transport transport
+	rt        http.RoundTripper // transport wrapped by record.Wrap()
+	cli       *http.Client
+	created   time.Time
+	lastUsed  int64 // unix nano
+	requests  int64
+	inflight  int64
+	openConns int64
+}
+
+func (pt *pooledTransport) dialContext(fn dialCtxFunc) dialCtxFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := dialWithTimeout(ctx, fn, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		atomic.AddInt64(&pt.openConns, 1)
+		return &countedConn{Conn: c, pt: pt}, nil
+	}
+}
+
+func (pt *pooledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.StoreInt64(&pt.lastUsed, time.Now().UnixNano())
+	atomic.AddInt64(&pt.requests, 1)
+	atomic.AddInt64(&pt.inflight, 1)
+	resp, err := pt.rt.RoundTrip(req)
+	if err != nil {
+		atomic.AddInt64(&pt.inflight, -1)
+		return nil, err
+	}
+	resp.Body = &trackedBody{ReadCloser: resp.Body, pt: pt}
+	return resp, nil
+}
+
+type transportStats struct {
+	Id          string    `json:"id"`
+	Created     time.Time `json:"created"`
+	LastUsed    time.Time `json:"lastUsed"`
+	Requests    int64     `json:"requests"`
+	OpenConns   int64     `json:"openConns"`
+	ActiveConns int64     `json:"activeConns"`
+	IdleConns   int64     `json:"idleConns"`
+}
+
+func (pt *pooledTransport) stats() transportStats {
+	open := atomic.LoadInt64(&pt.openConns)
+	// a http/2 connection can serve multiple requests at the same time,
+	// so the number of in-flight requests is only an approximation of
+	// the active connections.
+	active := atomic.LoadInt64(&pt.inflight)
+	if active > open {
+		active = open
+	}
+	return transportStats{
+		Id:          pt.id,
+		Created:     pt.created,
+		LastUsed:    time.Unix(0, atomic.LoadInt64(&pt.lastUsed)),
+		Requests:    atomic.LoadInt64(&pt.requests),
+		OpenConns:   open,
+		ActiveConns: active,
+		IdleConns:   open - active,
+	}
+}
+
+// transportPool keeps upstream transports in LRU order, so that the number
+// of transports is bounded even if identifiers vary per request.
+type transportPool struct {
+	mu    sync.Mutex
+	ll    *list.List // of *pooledTransport, the front is the most recent one
+	items map[string]*list.Element
+}
+
+func newTransportPool() *transportPool {
+	return &transportPool{
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (p *transportPool) get(id string, create func() *pooledTransport) *pooledTransport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.items[id]; ok {
+		p.ll.MoveToFront(e)
+		return e.Value.(*pooledTransport)
+	}
+	pt := create()
+	p.items[id] = p.ll.PushFront(pt)
+	for p.ll.Len() > *poolSize && p.ll.Len() > 1 {
+		p.removeLocked(p.ll.Back())
+	}
+	return pt
+}
+
+func (p *transportPool) removeLocked(e *list.Element) {
+	pt := e.Value.(*pooledTransport)
+	p.ll.Remove(e)
+	delete(p.items, pt.id)
+	// connections in use will be closed once the requests are done,
+	// because they can't go back to the idle pool of an evicted transport.
+	pt.transport.CloseIdleConnections()
+	logger.Debugf("transport %s evicted", pt.id)
+}
+
+func (p *transportPool) purge() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.ll.Len() > 0 {
+		p.removeLocked(p.ll.Back())
+	}
+}
+
+func (p *transportPool) snapshot() []transportStats {
+	p.mu.Lock()
+	var pts []*pooledTransport
+	for e := p.ll.Front(); e != nil; e = e.Next() {
+		pts = append(pts, e.Value.(*pooledTransport))
+	}
+	p.mu.Unlock()
+	result := make([]transportStats, 0, len(pts))
+	for _, pt := range pts {
+		result = append(result, pt.stats())
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Id < result[j].Id
+	})
+	return result
+}
+
+// ServeTransports lists live upstream transports and their connections.
+func ServeTransports(w http.ResponseWriter, req *http.Request) {
+	admin.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"max":        *poolSize,
+		"transports": transports.snapshot(),
+	})
+}
@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransportPoolEviction(t *testing.T) {
+	old := *poolSize
+	*poolSize = 2
+	defer func() { *poolSize = old }()
+
+	p := newTransportPool()
+	created := 0
+	get := func(id string) *pooledTransport {
+		return p.get(id, func() *pooledTransport {
+			created++
+			return &pooledTransport{id: id, transport: &http.Transport{}}
+		})
+	}
+	a := get("a")
+	get("b")
+	assert.Same(t, a, get("a")) // "a" becomes the most recent one
+	get("c")                    // evicts "b"
+	assert.Equal(t, 3, created)
+
+	var ids []string
+	for _, st := range p.snapshot() {
+		ids = append(ids, st.Id)
+	}
+	assert.Equal(t, []string{"a", "c"}, ids)
+
+	get("b")
+	assert.Equal(t, 4, created)
+	p.purge()
+	assert.Empty(t, p.snapshot())
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/zjx20/urlproxy/urlopts"
+)
+
+var (
+	headerUpstreamProto = http.CanonicalHeaderKey("X-Urlproxy-Upstream-Proto")
+)
+
+// connOptions are the options of the upstream connections of a
+// *http.Transport, they default to the -max-conns-per-host and
+// -idle-conn-timeout flags. HTTP/2 only transports take them from the
+// *http.Transport they are configured from, except maxConnsPerHost.
+type connOptions struct {
+	http1           bool
+	keepAlive       bool
+	idleConnTimeout time.Duration
+	maxConnsPerHost int
+}
+
+// connOptionsOf returns the connection options, and the part of the
+// transport identifier for the ones set by the options.
+func connOptionsOf(opts *urlopts.Options) (c connOptions, identifier string) {
+	c = connOptions{
+		keepAlive:       true,
+		idleConnTimeout: *idleConnTimeout,
+		maxConnsPerHost: *maxConnsPerHost,
+	}
+	if version, _ := urlopts.OptHttpVersion.ValueFrom(opts); version == "1.1" {
+		c.http1 = true
+		identifier += "[http:1.1]"
+	}
+	if keepAlive, ok := urlopts.OptKeepAlive.ValueFrom(opts); ok && !keepAlive {
+		c.keepAlive = false
+		identifier += "[keepalive:off]"
+	}
+	if ms, ok := urlopts.OptIdleConnTimeoutMs.ValueFrom(opts); ok && ms > 0 {
+		c.idleConnTimeout = time.Duration(ms) * time.Millisecond
+		identifier += fmt.Sprintf("[idleconn:%s]", c.idleConnTimeout)
+	}
+	if n, ok := urlopts.OptMaxConnsPerHost.ValueFrom(opts); ok && n >= 0 {
+		c.maxConnsPerHost = int(n)
+		identifier += fmt.Sprintf("[maxconns:%d]", n)
+	}
+	return
+}
+
+func (c connOptions) apply(t *http.Transport) {
+	if c.http1 {
+		// a non-nil empty map disables HTTP/2
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	t.DisableKeepAlives = !c.keepAlive
+	t.IdleConnTimeout = c.idleConnTimeout
+	t.MaxConnsPerHost = c.maxConnsPerHost
+}
+
+// checkHttpVersion validates uOptHttpVersion against the scheme of the
+// target url, and the connection options against HTTP/2 only targets.
+func checkHttpVersion(scheme string, opts *urlopts.Options) error {
+	if _, ok := urlopts.OptMaxConnsPerHost.ValueFrom(opts); ok && h2SchemeOf(opts) != "" {
+		// requests to a HTTP/2 host are multiplexed over one connection
+		return fmt.Errorf("uOptMaxConnsPerHost doesn't apply to HTTP/2 only targets")
+	}
+	version, ok := urlopts.OptHttpVersion.ValueFrom(opts)
+	if !ok {
+		return nil
+	}
+	if s, _ := urlopts.OptScheme.ValueFrom(opts); h2SchemeOf(opts) != "" && version == "1.1" {
+		return fmt.Errorf("uOptHttpVersion=1.1 conflicts with uOptScheme=%s", s)
+	}
+	switch {
+	case version == "2" && scheme != "https":
+		return fmt.Errorf("uOptHttpVersion=2 requires https, use h2c for cleartext HTTP/2")
+	case version == "h2c" && scheme != "http":
+		return fmt.Errorf("uOptHttpVersion=h2c requires http")
+	}
+	return nil
+}
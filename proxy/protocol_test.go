@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zjx20/urlproxy/app/info"
+	"github.com/zjx20/urlproxy/urlopts"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestHttpVersion(t *testing.T) {
+	var closed bool
+	var conns int32
+	upstream := httptest.NewUnstartedServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		closed = r.Close
+		w.Write([]byte(r.Proto))
+	}), &http2.Server{}))
+	upstream.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	upstream.Start()
+	defer upstream.Close()
+	info.SetListenAddr(upstream.Listener.Addr())
+
+	get := func(options string) *httptest.ResponseRecorder {
+		u, _ := url.Parse("/" + upstream.Listener.Addr().String() + "/?" + options)
+		after, opts := urlopts.Extract(u)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.URL = &after
+		rec := httptest.NewRecorder()
+		Handle(rec, req, opts)
+		return rec
+	}
+
+	rec := get("")
+	assert.Equal(t, "HTTP/1.1", rec.Body.String())
+	assert.Equal(t, "HTTP/1.1", rec.Header().Get(headerUpstreamProto))
+	assert.False(t, closed)
+
+	rec = get("uOptHttpVersion=h2c")
+	assert.Equal(t, "HTTP/2.0", rec.Body.String())
+	assert.Equal(t, "HTTP/2.0", rec.Header().Get(headerUpstreamProto))
+
+	rec = get("uOptHttpVersion=1.1&uOptKeepAlive=false&uOptMaxConnsPerHost=1")
+	assert.Equal(t, "HTTP/1.1", rec.Body.String())
+	assert.True(t, closed)
+
+	// each request of HTTP/2 without keep-alive has its own connection
+	before := atomic.LoadInt32(&conns)
+	for i := 0; i < 2; i++ {
+		rec = get("uOptHttpVersion=h2c&uOptKeepAlive=false")
+		assert.Equal(t, "HTTP/2.0", rec.Body.String())
+	}
+	assert.Equal(t, before+2, atomic.LoadInt32(&conns))
+
+	rec = get("uOptHttpVersion=2")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = get("uOptHttpVersion=h2c&uOptMaxConnsPerHost=1")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestConnOptionsIdentifier(t *testing.T) {
+	u, _ := url.Parse("/?uOptHttpVersion=1.1&uOptKeepAlive=false&uOptIdleConnTimeout=5s&uOptMaxConnsPerHost=4")
+	_, opts := urlopts.Extract(u)
+	c, identifier := connOptionsOf(opts)
+	assert.Equal(t, "[http:1.1][keepalive:off][idleconn:5s][maxconns:4]", identifier)
+	assert.False(t, c.keepAlive)
+
+	_, identifier = connOptionsOf(&urlopts.Options{})
+	assert.Empty(t, identifier)
+}
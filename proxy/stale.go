@@ -0,0 +1,287 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zjx20/urlproxy/kvstore"
+	"github.com/zjx20/urlproxy/logger"
+	"github.com/zjx20/urlproxy/urlopts"
+)
+
+var (
+	staleStoreSize = flag.Int("stale-store-size", 64<<20, "Max total bytes of the responses kept for uOptStaleIfError, the least recently used ones are evicted")
+	staleMaxBody   = flag.Int("stale-max-body", 4<<20, "Max body bytes of a response kept for uOptStaleIfError, larger responses are not kept")
+	stalePrivate   = flag.Bool("stale-private", false, "Also keep responses with Cache-Control: private, or to requests with Authorization or Cookie, for uOptStaleIfError")
+)
+
+const staleNamespace = "stale"
+
+var (
+	staleResponses = &staleStore{}
+
+	headerStale = http.CanonicalHeaderKey("X-Urlproxy-Stale")
+)
+
+// staleEntry is the last successful response of a url, stored in the
+// kvstore.
+type staleEntry struct {
+	URL        string      `json:"url"`
+	StatusCode int         `json:"statusCode"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+	Stored     time.Time   `json:"stored"`
+}
+
+type staleMeta struct {
+	size int64
+	used time.Time
+}
+
+// staleStore keeps the last successful responses in the kvstore. The index
+// of sizes and usage is in memory, and it's rebuilt from the kvstore at the
+// first use.
+type staleStore struct {
+	mu     sync.Mutex
+	loaded bool
+	index  map[string]*staleMeta // key => meta
+	total  int64
+}
+
+// load builds the index, the caller must hold s.mu.
+func (s *staleStore) load() {
+	if s.loaded {
+		return
+	}
+	s.loaded = true
+	s.index = map[string]*staleMeta{}
+	keys, err := kvstore.Keys(staleNamespace)
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		data, err := kvstore.Read(staleNamespace, key)
+		if err != nil {
+			continue
+		}
+		var e staleEntry
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			logger.Warnf("drop bad stale entry %s, err: %s", key, err)
+			kvstore.Delete(staleNamespace, key)
+			continue
+		}
+		s.index[key] = &staleMeta{size: int64(len(data)), used: e.Stored}
+		s.total += int64(len(data))
+	}
+	s.evict()
+}
+
+// evict removes the least recently used entries until the total size is
+// within -stale-store-size, the caller must hold s.mu.
+func (s *staleStore) evict() {
+	limit := int64(*staleStoreSize)
+	if s.total <= limit {
+		return
+	}
+	keys := make([]string, 0, len(s.index))
+	for key := range s.index {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return s.index[keys[i]].used.Before(s.index[keys[j]].used)
+	})
+	for _, key := range keys {
+		if s.total <= limit {
+			break
+		}
+		logger.Debugf("evict stale entry %s", key)
+		s.total -= s.index[key].size
+		delete(s.index, key)
+		kvstore.Delete(staleNamespace, key)
+	}
+}
+
+func (s *staleStore) put(key string, e *staleEntry) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		logger.Errorf("marshal stale entry of %s failed, err: %s", e.URL, err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.load()
+	if int64(len(data)) > int64(*staleStoreSize) {
+		return
+	}
+	if err := kvstore.Write(staleNamespace, key, string(data)); err != nil {
+		logger.Debugf("save stale entry of %s failed, err: %s", e.URL, err)
+		return
+	}
+	if m := s.index[key]; m != nil {
+		s.total -= m.size
+	}
+	s.index[key] = &staleMeta{size: int64(len(data)), used: time.Now()}
+	s.total += int64(len(data))
+	s.evict()
+}
+
+func (s *staleStore) get(key string) *staleEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.load()
+	m := s.index[key]
+	if m == nil {
+		return nil
+	}
+	data, err := kvstore.Read(staleNamespace, key)
+	if err != nil {
+		return nil
+	}
+	var e staleEntry
+	if err := json.Unmarshal([]byte(data), &e); err != nil {
+		return nil
+	}
+	m.used = time.Now()
+	return &e
+}
+
+// staleKey returns the key of the url, options and the -coalesce-vary
+// headers, uOptStaleIfError itself is excluded so that changing the
+// duration doesn't lose the entry.
+func staleKey(req *http.Request, proxyReq *http.Request, opts *urlopts.Options) string {
+	cloned := opts.Clone()
+	cloned.Remove(urlopts.OptStaleIfError)
+	sum := md5.Sum([]byte(req.URL.String() + "|" + urlopts.SortedOptionPath(cloned) +
+		varyHeaders(proxyReq)))
+	return hex.EncodeToString(sum[:])
+}
+
+// storable tells whether the response can be served as a stale response
+// later. Private responses are only kept with -stale-private.
+func storable(req *http.Request, proxyReq *http.Request, resp *http.Response) bool {
+	if req.Method != http.MethodGet || req.Header.Get("Range") != "" {
+		return false
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 || resp.StatusCode == http.StatusPartialContent {
+		return false
+	}
+	cacheControl := strings.ToLower(resp.Header.Get("Cache-Control"))
+	if strings.Contains(cacheControl, "no-store") {
+		return false
+	}
+	if !*stalePrivate && (strings.Contains(cacheControl, "private") ||
+		proxyReq.Header.Get("Authorization") != "" || proxyReq.Header.Get("Cookie") != "") {
+		return false
+	}
+	return resp.Header.Get(headerCoalesced) == ""
+}
+
+// staleCapture keeps the body read from the response, the entry is stored
+// when the body is read to the end.
+type staleCapture struct {
+	io.ReadCloser
+	key   string
+	entry *staleEntry
+	buf   bytes.Buffer
+	over  bool
+}
+
+func (c *staleCapture) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if n > 0 && !c.over {
+		if c.buf.Len()+n > *staleMaxBody {
+			c.over = true
+			c.buf = bytes.Buffer{}
+		} else {
+			c.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !c.over && c.entry != nil {
+		c.entry.Body = c.buf.Bytes()
+		c.entry.Stored = time.Now()
+		staleResponses.put(c.key, c.entry)
+		c.entry = nil
+	}
+	return n, err
+}
+
+// staleResponse makes the response from the entry.
+func staleResponse(e *staleEntry, proxyReq *http.Request, reason string) *http.Response {
+	header := e.Header.Clone()
+	header.Set("Age", strconv.Itoa(int(time.Since(e.Stored)/time.Second)))
+	header.Add("Warning", `110 urlproxy "Response is Stale"`)
+	header.Set(headerStale, reason)
+	body := e.Body
+	if proxyReq.Method == http.MethodHead {
+		body = nil
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode)),
+		StatusCode:    e.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       proxyReq,
+	}
+}
+
+// withStaleIfError keeps the successful response for uOptStaleIfError, or
+// replaces the failure by the last successful response if it's not older
+// than the option.
+func withStaleIfError(req *http.Request, proxyReq *http.Request, resp *http.Response, err error,
+	opts *urlopts.Options) (*http.Response, error) {
+	maxStale, ok := urlopts.OptStaleIfError.ValueFrom(opts)
+	if !ok || maxStale <= 0 || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return resp, err
+	}
+	key := staleKey(req, proxyReq, opts)
+	if err == nil && resp.StatusCode < 500 {
+		if storable(req, proxyReq, resp) {
+			header := resp.Header.Clone()
+			// cookies are not replayed to other clients
+			header.Del("Set-Cookie")
+			resp.Body = &staleCapture{
+				ReadCloser: resp.Body,
+				key:        key,
+				entry: &staleEntry{
+					URL:        proxyReq.URL.String(),
+					StatusCode: resp.StatusCode,
+					Header:     header,
+				},
+			}
+		}
+		return resp, err
+	}
+	if errors.Is(req.Context().Err(), context.Canceled) {
+		// the client has gone
+		return resp, err
+	}
+	e := staleResponses.get(key)
+	if e == nil || time.Since(e.Stored) > maxStale {
+		return resp, err
+	}
+	reason := "error"
+	if err == nil {
+		reason = strconv.Itoa(resp.StatusCode)
+		resp.Body.Close()
+	}
+	logger.Warnf("serve stale response of %s stored at %s, reason: %s",
+		e.URL, e.Stored.Format(time.RFC3339), reason)
+	return staleResponse(e, proxyReq, reason), nil
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zjx20/urlproxy/app/info"
+	"github.com/zjx20/urlproxy/kvstore"
+	"github.com/zjx20/urlproxy/urlopts"
+)
+
+func TestStaleIfError(t *testing.T) {
+	require.NoError(t, kvstore.InitKVStore(t.TempDir(), 0))
+	defer kvstore.Close()
+
+	var down int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&down) != 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Set-Cookie", "sid=1")
+		w.Write([]byte("good"))
+	}))
+	defer server.Close()
+	info.SetListenAddr(server.Listener.Addr())
+
+	get := func(options string) *httptest.ResponseRecorder {
+		u, _ := url.Parse("/" + server.Listener.Addr().String() + "/list?" + options)
+		after, opts := urlopts.Extract(u)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.URL = &after
+		rec := httptest.NewRecorder()
+		Handle(rec, req, opts)
+		return rec
+	}
+
+	rec := get("uOptStaleIfError=1m")
+	assert.Equal(t, "good", rec.Body.String())
+	assert.Empty(t, rec.Header().Get(headerStale))
+
+	atomic.StoreInt32(&down, 1)
+	rec = get("uOptStaleIfError=10m")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "good", rec.Body.String())
+	assert.Equal(t, "500", rec.Header().Get(headerStale))
+	assert.NotEmpty(t, rec.Header().Get("Warning"))
+	assert.Empty(t, rec.Header().Get("Set-Cookie"))
+
+	rec = get("")
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	rec = get("uOptStaleIfError=1m&uOptHeader=X-Other:1")
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+}
+
+func TestStaleStorable(t *testing.T) {
+	u, _ := url.Parse("/example.com/list?uOptStaleIfError=1m")
+	after, opts := urlopts.Extract(u)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.URL = &after
+	proxyReq, err := prepareProxyRequest(req, opts)
+	require.NoError(t, err)
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+	assert.True(t, storable(req, proxyReq, resp))
+
+	other := proxyReq.Clone(proxyReq.Context())
+	other.Header.Set("Accept-Language", "fr")
+	assert.NotEqual(t, staleKey(req, proxyReq, opts), staleKey(req, other, opts))
+
+	resp.Header.Set("Cache-Control", "private, max-age=60")
+	assert.False(t, storable(req, proxyReq, resp))
+	resp.Header.Del("Cache-Control")
+	other.Header.Set("Authorization", "Bearer x")
+	assert.False(t, storable(req, other, resp))
+
+	defer flag.Set("stale-private", "false")
+	flag.Set("stale-private", "true")
+	assert.True(t, storable(req, other, resp))
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/zjx20/urlproxy/urlopts"
+)
+
+// flushInterval returns how often the response should be flushed to the
+// client, 0 means flushing every write, and -1 means never. Event streams
+// and responses of unknown length are flushed every write, unless
+// uOptFlushMs says otherwise.
+func flushInterval(resp *http.Response, opts *urlopts.Options) time.Duration {
+	if opts != nil {
+		if ms, ok := urlopts.OptFlushMs.ValueFrom(opts); ok {
+			if ms < 0 {
+				return -1
+			}
+			return time.Duration(ms) * time.Millisecond
+		}
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == "text/event-stream" || resp.ContentLength == -1 {
+		return 0
+	}
+	return -1
+}
+
+// flushWriter flushes the written data within the interval.
+type flushWriter struct {
+	w        io.Writer
+	flusher  http.Flusher
+	interval time.Duration
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	pending bool
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	n, err := fw.w.Write(p)
+	if fw.interval == 0 {
+		fw.flusher.Flush()
+		return n, err
+	}
+	if fw.pending {
+		return n, err
+	}
+	fw.pending = true
+	if fw.timer == nil {
+		fw.timer = time.AfterFunc(fw.interval, fw.delayedFlush)
+	} else {
+		fw.timer.Reset(fw.interval)
+	}
+	return n, err
+}
+
+func (fw *flushWriter) delayedFlush() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if fw.pending {
+		fw.flusher.Flush()
+		fw.pending = false
+	}
+}
+
+func (fw *flushWriter) stop() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	fw.pending = false
+	if fw.timer != nil {
+		fw.timer.Stop()
+	}
+}
+
+// streamWriter returns the writer for copying the response body, and a
+// function to call after copying.
+func streamWriter(w http.ResponseWriter, resp *http.Response, opts *urlopts.Options) (io.Writer, func()) {
+	flusher, ok := w.(http.Flusher)
+	interval := flushInterval(resp, opts)
+	if !ok || interval < 0 {
+		return w, func() {}
+	}
+	// the header reaches the client before the first byte of the body,
+	// e.g. for long polls
+	flusher.Flush()
+	fw := &flushWriter{w: w, flusher: flusher, interval: interval}
+	return fw, fw.stop
+}
@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zjx20/urlproxy/app/info"
+	"github.com/zjx20/urlproxy/urlopts"
+)
+
+func TestStreaming(t *testing.T) {
+	next := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/events":
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte("data: 1\n\n"))
+			w.(http.Flusher).Flush()
+			<-next
+			w.Write([]byte("data: 2\n\n"))
+		case "/trailers":
+			w.Header().Set("Trailer", "X-Checksum")
+			w.Write([]byte("body"))
+			w.Header().Set("X-Checksum", "abc")
+		}
+	}))
+	defer upstream.Close()
+	info.SetListenAddr(upstream.Listener.Addr())
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		after, opts := urlopts.Extract(r.URL)
+		r.URL = &after
+		Handle(w, r, opts)
+	}))
+	defer server.Close()
+	base := server.URL + "/" + upstream.Listener.Addr().String()
+
+	resp, err := http.Get(base + "/events")
+	require.NoError(t, err)
+	rd := bufio.NewReader(resp.Body)
+	// the first event arrives before the upstream sends the second one
+	line, err := rd.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "data: 1\n", line)
+	close(next)
+	rest, _ := io.ReadAll(rd)
+	assert.Equal(t, "\ndata: 2\n\n", string(rest))
+	resp.Body.Close()
+
+	resp, err = http.Get(base + "/trailers")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "body", string(body))
+	assert.Equal(t, "abc", resp.Trailer.Get("X-Checksum"))
+}
@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/zjx20/urlproxy/urlopts"
+)
+
+type timeoutKind string
+
+const (
+	timeoutConnect timeoutKind = "connect"
+	timeoutHeader  timeoutKind = "first byte"
+	timeoutIdle    timeoutKind = "idle"
+)
+
+// errTimeout is returned when uOptConnectTimeoutMs, uOptHeaderTimeoutMs or
+// uOptIdleTimeoutMs is exceeded.
+type errTimeout struct {
+	kind  timeoutKind
+	after time.Duration
+}
+
+func (e *errTimeout) Error() string {
+	return fmt.Sprintf("%s timeout after %s", e.kind, e.after)
+}
+
+func (e *errTimeout) Timeout() bool {
+	return true
+}
+
+// connectTimeoutKey carries uOptConnectTimeoutMs in the request context to
+// the dialer of the pooled transport.
+type connectTimeoutKey struct{}
+
+func timeoutsOf(opts *urlopts.Options) (connect, header, idle time.Duration) {
+	ms, _ := urlopts.OptConnectTimeoutMs.ValueFrom(opts)
+	connect = time.Duration(ms) * time.Millisecond
+	ms, _ = urlopts.OptHeaderTimeoutMs.ValueFrom(opts)
+	header = time.Duration(ms) * time.Millisecond
+	ms, _ = urlopts.OptIdleTimeoutMs.ValueFrom(opts)
+	idle = time.Duration(ms) * time.Millisecond
+	return
+}
+
+func withConnectTimeout(ctx context.Context, d time.Duration) context.Context {
+	if d <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, connectTimeoutKey{}, d)
+}
+
+// dialWithTimeout dials with the connect timeout in the context, if any.
+func dialWithTimeout(ctx context.Context, fn dialCtxFunc, network, addr string) (net.Conn, error) {
+	d, _ := ctx.Value(connectTimeoutKey{}).(time.Duration)
+	if d <= 0 {
+		return fn(ctx, network, addr)
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+	c, err := fn(dialCtx, network, addr)
+	if err != nil && ctx.Err() == nil && errors.Is(dialCtx.Err(), context.DeadlineExceeded) {
+		return nil, &errTimeout{kind: timeoutConnect, after: d}
+	}
+	return c, err
+}
+
+// doTimedRequest is cli.Do with the connect, first byte and idle timeouts
+// of the options. Unlike uOptTimeoutMs, they apply to each attempt.
+func doTimedRequest(cli *http.Client, proxyReq *http.Request, opts *urlopts.Options) (*http.Response, error) {
+	connect, header, idle := timeoutsOf(opts)
+	if connect <= 0 && header <= 0 && idle <= 0 {
+		return cli.Do(proxyReq)
+	}
+	ctx, cancel := context.WithCancel(withConnectTimeout(proxyReq.Context(), connect))
+	var state int32 // 0: waiting, 1: timed out, 2: got the header
+	if header > 0 {
+		timer := time.AfterFunc(header, func() {
+			if atomic.CompareAndSwapInt32(&state, 0, 1) {
+				cancel()
+			}
+		})
+		defer timer.Stop()
+	}
+	resp, err := cli.Do(proxyReq.WithContext(ctx))
+	if !atomic.CompareAndSwapInt32(&state, 0, 2) {
+		if err == nil {
+			resp.Body.Close()
+		}
+		cancel()
+		return nil, &errTimeout{kind: timeoutHeader, after: header}
+	}
+	if err != nil {
+		cancel()
+		return resp, err
+	}
+	resp.Body = newTimedBody(resp.Body, idle, cancel)
+	return resp, nil
+}
+
+// timedBody cancels the request when it's closed, or when a read waits for
+// the upstream longer than the idle timeout. The time between the reads,
+// e.g. writing to a slow client, doesn't count.
+type timedBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+	idle   time.Duration
+	timer  *time.Timer
+	fired  int32
+}
+
+func newTimedBody(rc io.ReadCloser, idle time.Duration, cancel context.CancelFunc) *timedBody {
+	b := &timedBody{ReadCloser: rc, cancel: cancel, idle: idle}
+	if idle > 0 {
+		b.timer = time.AfterFunc(idle, func() {
+			atomic.StoreInt32(&b.fired, 1)
+			cancel()
+		})
+		// armed by Read()
+		b.timer.Stop()
+	}
+	return b
+}
+
+func (b *timedBody) Read(p []byte) (int, error) {
+	if b.timer == nil {
+		return b.ReadCloser.Read(p)
+	}
+	if atomic.LoadInt32(&b.fired) == 0 {
+		b.timer.Reset(b.idle)
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.timer.Stop()
+	if atomic.LoadInt32(&b.fired) != 0 && err != nil && err != io.EOF {
+		err = &errTimeout{kind: timeoutIdle, after: b.idle}
+	}
+	return n, err
+}
+
+func (b *timedBody) Close() error {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// progressReader calls feed whenever something is read.
+type progressReader struct {
+	r    io.Reader
+	feed func()
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	if n > 0 {
+		pr.feed()
+	}
+	return n, err
+}
+
+// respondTimeout responds 504 with the kind of the timeout.
+func respondTimeout(w http.ResponseWriter, e *errTimeout) {
+	w.WriteHeader(http.StatusGatewayTimeout)
+	w.Write([]byte(e.Error()))
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zjx20/urlproxy/app/info"
+	"github.com/zjx20/urlproxy/urlopts"
+)
+
+func TestTimeouts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow-header":
+			time.Sleep(200 * time.Millisecond)
+		case "/stall":
+			w.Write([]byte("partial"))
+			w.(http.Flusher).Flush()
+			time.Sleep(200 * time.Millisecond)
+		case "/trickle":
+			for i := 0; i < 5; i++ {
+				w.Write([]byte("x"))
+				w.(http.Flusher).Flush()
+				time.Sleep(20 * time.Millisecond)
+			}
+		}
+	}))
+	defer server.Close()
+	info.SetListenAddr(server.Listener.Addr())
+
+	get := func(path string) *httptest.ResponseRecorder {
+		u, _ := url.Parse("/" + server.Listener.Addr().String() + path)
+		after, opts := urlopts.Extract(u)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.URL = &after
+		rec := httptest.NewRecorder()
+		Handle(rec, req, opts)
+		return rec
+	}
+
+	rec := get("/slow-header?uOptHeaderTimeout=50ms")
+	assert.Equal(t, http.StatusGatewayTimeout, rec.Code)
+	assert.Equal(t, "first byte timeout after 50ms", rec.Body.String())
+
+	rec = get("/stall?uOptIdleTimeout=50ms")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "partial", rec.Body.String())
+
+	// the idle timeout is not a deadline of the whole body
+	rec = get("/trickle?uOptIdleTimeout=50ms&uOptHeaderTimeout=50ms")
+	assert.Equal(t, "xxxxx", rec.Body.String())
+
+	// the time spent on writing to a slow client is not idle
+	u, _ := url.Parse("/" + server.Listener.Addr().String() + "/trickle?uOptIdleTimeout=50ms")
+	after, opts := urlopts.Extract(u)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.URL = &after
+	slow := &slowWriter{ResponseRecorder: httptest.NewRecorder(), delay: 80 * time.Millisecond}
+	Handle(slow, req, opts)
+	assert.Equal(t, "xxxxx", slow.Body.String())
+
+	// a dialer that never connects
+	hang := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	ctx := withConnectTimeout(context.Background(), 50*time.Millisecond)
+	_, err := dialWithTimeout(ctx, hang, "tcp", "example.com:80")
+	assert.EqualError(t, err, "connect timeout after 50ms")
+}
+
+// slowWriter is a client reading the response slowly.
+type slowWriter struct {
+	*httptest.ResponseRecorder
+	delay time.Duration
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(w.delay)
+	return w.ResponseRecorder.Write(p)
+}
@@ -0,0 +1,533 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zjx20/urlproxy/admin"
+	"github.com/zjx20/urlproxy/logger"
+	"github.com/zjx20/urlproxy/urlopts"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	policyRoundRobin = "round-robin"
+	policyLeastConn  = "least-conn"
+	policyHash       = "hash"
+
+	defaultMaxFails    = 3
+	defaultFailTimeout = 30 * time.Second
+
+	// inline groups are kept for their states, they are dropped all
+	// together if exceeded.
+	maxInlineGroups = 256
+)
+
+// UpstreamOrigin is an origin of an upstream group in the config file.
+// It can be a mapping, or a scalar of the host.
+type UpstreamOrigin struct {
+	Host   string `yaml:"host"`
+	Weight int    `yaml:"weight,omitempty"`
+}
+
+func (o *UpstreamOrigin) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		o.Host = node.Value
+		return nil
+	}
+	type plain UpstreamOrigin
+	return node.Decode((*plain)(o))
+}
+
+// HealthCheck configures the active health checks of an upstream group.
+type HealthCheck struct {
+	Path     string        `yaml:"path"`
+	Scheme   string        `yaml:"scheme,omitempty"`   // http by default
+	Interval time.Duration `yaml:"interval,omitempty"` // 10s by default
+	Timeout  time.Duration `yaml:"timeout,omitempty"`  // 5s by default
+	// Profile is the option profile for the health checks, so that they
+	// go through the same dialer chain (e.g. uOptSocks) as the requests.
+	Profile string `yaml:"profile,omitempty"`
+}
+
+// UpstreamConfig is an upstream group in the config file.
+type UpstreamConfig struct {
+	Origins     []*UpstreamOrigin `yaml:"origins"`
+	Policy      string            `yaml:"policy,omitempty"`
+	MaxFails    int               `yaml:"max_fails,omitempty"`
+	FailTimeout time.Duration     `yaml:"fail_timeout,omitempty"`
+	HealthCheck *HealthCheck      `yaml:"health_check,omitempty"`
+}
+
+// Check validates the config, and fills the default values.
+func (c *UpstreamConfig) Check() error {
+	if len(c.Origins) == 0 {
+		return fmt.Errorf("no origins")
+	}
+	for _, o := range c.Origins {
+		if o.Host == "" {
+			return fmt.Errorf("empty host of origin")
+		}
+		if o.Weight < 0 {
+			return fmt.Errorf("negative weight of origin %s", o.Host)
+		}
+		if o.Weight == 0 {
+			o.Weight = 1
+		}
+	}
+	switch c.Policy {
+	case "":
+		c.Policy = policyRoundRobin
+	case policyRoundRobin, policyLeastConn, policyHash:
+	default:
+		return fmt.Errorf("unknown policy %s", c.Policy)
+	}
+	if c.MaxFails == 0 {
+		c.MaxFails = defaultMaxFails
+	}
+	if c.FailTimeout == 0 {
+		c.FailTimeout = defaultFailTimeout
+	}
+	if hc := c.HealthCheck; hc != nil {
+		if !strings.HasPrefix(hc.Path, "/") {
+			return fmt.Errorf("path of health check should start with /")
+		}
+		if hc.Scheme == "" {
+			hc.Scheme = "http"
+		}
+		if hc.Interval <= 0 {
+			hc.Interval = 10 * time.Second
+		}
+		if hc.Timeout <= 0 {
+			hc.Timeout = 5 * time.Second
+		}
+	}
+	return nil
+}
+
+type origin struct {
+	host   string
+	weight int
+
+	// guarded by the mutex of the group
+	current      int // for the smooth weighted round-robin
+	fails        int
+	ejectedUntil time.Time
+	down         bool // by health checks
+
+	inflight int64
+}
+
+type upstreamGroup struct {
+	name    string
+	cfg     *UpstreamConfig
+	origins []*origin
+
+	mu     sync.Mutex
+	cancel context.CancelFunc // stops health checks
+}
+
+func newUpstreamGroup(name string, cfg *UpstreamConfig) *upstreamGroup {
+	g := &upstreamGroup{name: name, cfg: cfg}
+	for _, o := range cfg.Origins {
+		g.origins = append(g.origins, &origin{host: o.Host, weight: o.Weight})
+	}
+	return g
+}
+
+func (g *upstreamGroup) available(o *origin, now time.Time) bool {
+	return !o.down && !now.Before(o.ejectedUntil) && !breakers.isOpen(o.host)
+}
+
+// pick selects an origin for the request with the key (path), origins in
+// exclude are skipped if possible. Ejected origins, and origins with open
+// circuit breakers, are only used if all origins are unavailable. With
+// peek, the state of the round-robin is left untouched.
+func (g *upstreamGroup) pick(key string, exclude map[string]bool, peek bool) *origin {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	var candidates []*origin
+	for _, o := range g.origins {
+		if !exclude[o.host] && g.available(o, now) {
+			candidates = append(candidates, o)
+		}
+	}
+	if len(candidates) == 0 {
+		for _, o := range g.origins {
+			if !exclude[o.host] {
+				candidates = append(candidates, o)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = g.origins
+	}
+	switch g.cfg.Policy {
+	case policyLeastConn:
+		var best *origin
+		for _, o := range candidates {
+			if best == nil || atomic.LoadInt64(&o.inflight)*int64(best.weight) <
+				atomic.LoadInt64(&best.inflight)*int64(o.weight) {
+				best = o
+			}
+		}
+		return best
+	case policyHash:
+		// weighted rendezvous hashing, only the requests of the removed
+		// origin are moved when an origin is ejected
+		var best *origin
+		bestScore := math.Inf(-1)
+		for _, o := range candidates {
+			h := fnv.New64a()
+			h.Write([]byte(o.host + "|" + key))
+			u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+			score := -float64(o.weight) / math.Log(u)
+			if score > bestScore {
+				best, bestScore = o, score
+			}
+		}
+		return best
+	default:
+		// smooth weighted round-robin
+		var best *origin
+		total := 0
+		for _, o := range candidates {
+			total += o.weight
+			if best == nil || o.current+o.weight > best.current+best.weight {
+				best = o
+			}
+		}
+		if !peek {
+			for _, o := range candidates {
+				o.current += o.weight
+			}
+			best.current -= total
+		}
+		return best
+	}
+}
+
+// report updates the passive ejection state of the origin. An origin is
+// ejected for FailTimeout after MaxFails consecutive failures.
+func (g *upstreamGroup) report(host string, failed bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, o := range g.origins {
+		if o.host != host {
+			continue
+		}
+		if !failed {
+			o.fails = 0
+			return
+		}
+		o.fails++
+		if o.fails >= g.cfg.MaxFails {
+			logger.Warnf("upstream %s: eject origin %s for %s, failures: %d",
+				g.name, host, g.cfg.FailTimeout, o.fails)
+			o.ejectedUntil = time.Now().Add(g.cfg.FailTimeout)
+			o.fails = 0
+		}
+		return
+	}
+}
+
+func (g *upstreamGroup) find(host string) *origin {
+	for _, o := range g.origins {
+		if o.host == host {
+			return o
+		}
+	}
+	return nil
+}
+
+func (g *upstreamGroup) healthCheck(ctx context.Context) {
+	hc := g.cfg.HealthCheck
+	ticker := time.NewTicker(hc.Interval)
+	defer ticker.Stop()
+	for {
+		for _, o := range g.origins {
+			healthy := g.probe(ctx, o.host)
+			g.mu.Lock()
+			if o.down == healthy {
+				logger.Infof("upstream %s: origin %s healthy: %v", g.name, o.host, healthy)
+			}
+			o.down = !healthy
+			g.mu.Unlock()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe checks the origin through the same dialer chain as the requests
+// with the options of the profile.
+func (g *upstreamGroup) probe(ctx context.Context, host string) bool {
+	hc := g.cfg.HealthCheck
+	opts := &urlopts.Options{}
+	if hc.Profile != "" {
+		opts.Set(urlopts.OptProfile.New(hc.Profile))
+	}
+	if err := urlopts.ApplyPresets(opts); err != nil {
+		logger.Errorf("upstream %s: health check failed, err: %s", g.name, err)
+		return false
+	}
+	ctx, cancel := context.WithTimeout(ctx, hc.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		hc.Scheme+"://"+host+hc.Path, nil)
+	if err != nil {
+		logger.Errorf("upstream %s: health check failed, err: %s", g.name, err)
+		return false
+	}
+	resp, err := probeCli(host, opts).Do(req)
+	if err != nil {
+		logger.Debugf("upstream %s: health check of %s failed, err: %s", g.name, host, err)
+		return false
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return goodStatusCode(resp.StatusCode)
+}
+
+// probeCli returns the client for the health checks of the origin, it's
+// kept in the transport pool like the ones of the requests, so that the
+// connections are reused across the checks.
+func probeCli(host string, opts *urlopts.Options) *http.Client {
+	dialCtxFn, identifier := getDialer(host, opts)
+	identifier = "[probe]" + identifier
+	pt := transports.get(identifier, func() *pooledTransport {
+		pt := &pooledTransport{
+			id:      identifier,
+			created: time.Now(),
+		}
+		transport := &http.Transport{
+			DialContext:     pt.dialContext(dialCtxFn),
+			MaxIdleConns:    *maxIdleConns,
+			IdleConnTimeout: *idleConnTimeout,
+		}
+		pt.transport = transport
+		pt.rt = transport
+		pt.cli = &http.Client{
+			Transport: pt,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		return pt
+	})
+	return pt.cli
+}
+
+var (
+	upstreamsMu    sync.Mutex
+	upstreamGroups = map[string]*upstreamGroup{} // name => group
+	inlineGroups   = map[string]*upstreamGroup{} // policy|hosts => group
+)
+
+// SetUpstreams replaces the upstream groups, the configs should have been
+// checked by UpstreamConfig.Check().
+func SetUpstreams(cfgs map[string]*UpstreamConfig) {
+	upstreamsMu.Lock()
+	defer upstreamsMu.Unlock()
+	for _, g := range upstreamGroups {
+		if g.cancel != nil {
+			g.cancel()
+		}
+	}
+	upstreamGroups = map[string]*upstreamGroup{}
+	for name, cfg := range cfgs {
+		g := newUpstreamGroup(name, cfg)
+		if cfg.HealthCheck != nil {
+			var ctx context.Context
+			ctx, g.cancel = context.WithCancel(context.Background())
+			go g.healthCheck(ctx)
+		}
+		upstreamGroups[name] = g
+	}
+}
+
+// Upstreams returns the configs of the upstream groups.
+func Upstreams() map[string]*UpstreamConfig {
+	upstreamsMu.Lock()
+	defer upstreamsMu.Unlock()
+	result := map[string]*UpstreamConfig{}
+	for name, g := range upstreamGroups {
+		result[name] = g.cfg
+	}
+	return result
+}
+
+// upstreamOf returns the upstream group of the request, which is named by
+// uOptUpstream, or inlined in uOptHost like "a.com,b.com". It returns nil
+// if the target is a single host.
+func upstreamOf(opts *urlopts.Options) (*upstreamGroup, error) {
+	upstreamsMu.Lock()
+	defer upstreamsMu.Unlock()
+	if name, ok := urlopts.OptUpstream.ValueFrom(opts); ok {
+		g := upstreamGroups[name]
+		if g == nil {
+			return nil, fmt.Errorf("unknown upstream %s", name)
+		}
+		return g, nil
+	}
+	host, _ := urlopts.OptHost.ValueFrom(opts)
+	if !strings.Contains(host, ",") {
+		return nil, nil
+	}
+	policy, _ := urlopts.OptLbPolicy.ValueFrom(opts)
+	key := policy + "|" + host
+	if g := inlineGroups[key]; g != nil {
+		return g, nil
+	}
+	cfg := &UpstreamConfig{Policy: policy}
+	for _, h := range strings.Split(host, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			cfg.Origins = append(cfg.Origins, &UpstreamOrigin{Host: h})
+		}
+	}
+	if err := cfg.Check(); err != nil {
+		return nil, fmt.Errorf("bad upstream %s: %w", host, err)
+	}
+	if len(inlineGroups) >= maxInlineGroups {
+		inlineGroups = map[string]*upstreamGroup{}
+	}
+	g := newUpstreamGroup(host, cfg)
+	inlineGroups[key] = g
+	return g, nil
+}
+
+// releaseBody calls release when the response body is closed.
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	b.once.Do(b.release)
+	return b.ReadCloser.Close()
+}
+
+// doOriginRequest is doGuardedRequest with the states of the origin in
+// the upstream group updated.
+func doOriginRequest(g *upstreamGroup, cli *http.Client, proxyReq *http.Request,
+	opts *urlopts.Options) (*http.Response, error) {
+	if g == nil {
+		return doGuardedRequest(cli, proxyReq, opts)
+	}
+	host := proxyReq.URL.Host
+	o := g.find(host)
+	if o == nil {
+		return doGuardedRequest(cli, proxyReq, opts)
+	}
+	atomic.AddInt64(&o.inflight, 1)
+	release := func() { atomic.AddInt64(&o.inflight, -1) }
+	resp, err := doGuardedRequest(cli, proxyReq, opts)
+	var openErr *errBreakerOpen
+	failed := upstreamFailed(resp, err)
+	if !errors.As(err, &openErr) && !(failed && failureByClient(opts)) {
+		g.report(host, failed)
+	}
+	if err != nil {
+		release()
+		return resp, err
+	}
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// moveToNextOrigin points the request to an origin that hasn't been tried,
+// all origins are tried again if exhausted.
+func moveToNextOrigin(g *upstreamGroup, proxyReq *http.Request, tried map[string]bool) {
+	o := g.pick(proxyReq.URL.Path, tried, false)
+	if tried[o.host] {
+		for k := range tried {
+			delete(tried, k)
+		}
+	}
+	tried[o.host] = true
+	// the url may be shared with other requests in the race mode
+	u := *proxyReq.URL
+	u.Host = o.host
+	proxyReq.URL = &u
+	proxyReq.Host = o.host
+}
+
+type originStats struct {
+	Host     string     `json:"host"`
+	Weight   int        `json:"weight"`
+	Inflight int64      `json:"inflight"`
+	Fails    int        `json:"fails"`
+	Ejected  *time.Time `json:"ejectedUntil,omitempty"`
+	Down     bool       `json:"down"`
+}
+
+type groupStats struct {
+	Name    string        `json:"name"`
+	Policy  string        `json:"policy"`
+	Origins []originStats `json:"origins"`
+}
+
+func (g *upstreamGroup) stats() groupStats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s := groupStats{Name: g.name, Policy: g.cfg.Policy}
+	now := time.Now()
+	for _, o := range g.origins {
+		st := originStats{
+			Host:     o.host,
+			Weight:   o.weight,
+			Inflight: atomic.LoadInt64(&o.inflight),
+			Fails:    o.fails,
+			Down:     o.down,
+		}
+		if now.Before(o.ejectedUntil) {
+			until := o.ejectedUntil
+			st.Ejected = &until
+		}
+		s.Origins = append(s.Origins, st)
+	}
+	return s
+}
+
+// ServeUpstreams lists the upstream groups in the config file, and the
+// inline ones in use, with the states of their origins.
+func ServeUpstreams(w http.ResponseWriter, req *http.Request) {
+	upstreamsMu.Lock()
+	var named, inline []*upstreamGroup
+	for _, g := range upstreamGroups {
+		named = append(named, g)
+	}
+	for _, g := range inlineGroups {
+		inline = append(inline, g)
+	}
+	upstreamsMu.Unlock()
+	collect := func(groups []*upstreamGroup) []groupStats {
+		result := make([]groupStats, 0, len(groups))
+		for _, g := range groups {
+			result = append(result, g.stats())
+		}
+		sort.Slice(result, func(i, j int) bool {
+			return result[i].Name < result[j].Name
+		})
+		return result
+	}
+	admin.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"upstreams": collect(named),
+		"inline":    collect(inline),
+	})
+}
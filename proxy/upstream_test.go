@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zjx20/urlproxy/app/info"
+	"github.com/zjx20/urlproxy/urlopts"
+)
+
+func TestUpstreamPick(t *testing.T) {
+	cfg := &UpstreamConfig{Origins: []*UpstreamOrigin{
+		{Host: "a", Weight: 3}, {Host: "b"},
+	}}
+	require.NoError(t, cfg.Check())
+	g := newUpstreamGroup("test", cfg)
+	counts := map[string]int{}
+	for i := 0; i < 8; i++ {
+		counts[g.pick("/", nil, false).host]++
+	}
+	assert.Equal(t, map[string]int{"a": 6, "b": 2}, counts)
+
+	// ejected origins are skipped
+	for i := 0; i < defaultMaxFails; i++ {
+		g.report("a", true)
+	}
+	assert.Equal(t, "b", g.pick("/", nil, false).host)
+	assert.Equal(t, "b", g.pick("/", nil, false).host)
+	// unless all of them are ejected
+	assert.Equal(t, "a", g.pick("/", map[string]bool{"b": true}, false).host)
+
+	// peeking doesn't advance the round-robin
+	g = newUpstreamGroup("test", &UpstreamConfig{Policy: policyRoundRobin,
+		Origins: []*UpstreamOrigin{{Host: "a", Weight: 1}, {Host: "b", Weight: 1}}})
+	assert.Equal(t, "a", g.pick("/", nil, true).host)
+	assert.Equal(t, "a", g.pick("/", nil, true).host)
+	assert.Equal(t, "a", g.pick("/", nil, false).host)
+	assert.Equal(t, "b", g.pick("/", nil, true).host)
+
+	// origins with open circuit breakers are skipped
+	for i := 0; i < *breakerFailures; i++ {
+		breakers.record(breakerKey{host: "b"}, true)
+	}
+	defer breakers.record(breakerKey{host: "b"}, false)
+	assert.Equal(t, "a", g.pick("/", nil, false).host)
+	assert.Equal(t, "a", g.pick("/", nil, false).host)
+
+	cfg = &UpstreamConfig{Policy: policyHash, Origins: []*UpstreamOrigin{
+		{Host: "a"}, {Host: "b"}, {Host: "c"},
+	}}
+	require.NoError(t, cfg.Check())
+	g = newUpstreamGroup("test", cfg)
+	for i := 0; i < 10; i++ {
+		path := fmt.Sprintf("/path/%d", i)
+		assert.Equal(t, g.pick(path, nil, false).host, g.pick(path, nil, false).host)
+	}
+}
+
+func TestUpstreamRetries(t *testing.T) {
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("good"))
+	}))
+	defer good.Close()
+	info.SetListenAddr(good.Listener.Addr())
+	bad := "127.0.0.1:1" // refused
+	hosts := bad + "," + good.Listener.Addr().String()
+
+	for i := 0; i < 4; i++ {
+		u, _ := url.Parse("/uOptHost=" + hosts + "/get?uOptRetriesError=1")
+		after, opts := urlopts.Extract(u)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.URL = &after
+		rec := httptest.NewRecorder()
+		Handle(rec, req, opts)
+		assert.Equal(t, "good", rec.Body.String())
+	}
+}
@@ -0,0 +1,192 @@
+package record
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zjx20/urlproxy/logger"
+)
+
+var (
+	recordDir = flag.String("record", "", "Record upstream requests and responses into the dir")
+	replayDir = flag.String("replay", "", "Serve responses recorded by -record from the dir, instead of requesting upstream")
+
+	replayMatchMethod  = flag.Bool("replay-match-method", true, "Whether the request method must match when replaying")
+	replayMatchHeaders = flag.String("replay-match-headers", "", "Comma-separated request headers that must match when replaying")
+	replayIgnoreParams = flag.String("replay-ignore-params", "__t", "Comma-separated query parameters ignored when replaying")
+	replayLatency      = flag.Duration("replay-latency", 0, "Simulated latency for replayed responses")
+	replayRealLatency  = flag.Bool("replay-recorded-latency", false, "Simulate the latency as it was recorded, -replay-latency is added on top of it")
+)
+
+const (
+	metaSuffix     = ".json"
+	reqBodySuffix  = ".req.body"
+	respBodySuffix = ".resp.body"
+)
+
+var (
+	seq      int64
+	replayer *replayTransport
+)
+
+// entry is the on-disk format of a recorded request/response pair, the
+// bodies are saved into separate files next to it.
+type entry struct {
+	Method        string      `json:"method"`
+	URL           string      `json:"url"`
+	ReqHeader     http.Header `json:"reqHeader"`
+	StatusCode    int         `json:"statusCode"`
+	RespHeader    http.Header `json:"respHeader"`
+	RespTrailer   http.Header `json:"respTrailer,omitempty"`
+	Time          time.Time   `json:"time"`
+	HeaderLatency int64       `json:"headerLatencyMs"`
+	// false if the response body was not fully read, e.g. the client
+	// disconnected before the end.
+	Complete bool `json:"complete"`
+}
+
+// Init checks the flags and loads the recorded responses for replaying.
+func Init() error {
+	if *recordDir != "" && *replayDir != "" {
+		return fmt.Errorf("-record and -replay can't be used at the same time")
+	}
+	if *recordDir != "" {
+		if err := os.MkdirAll(*recordDir, 0755); err != nil {
+			return err
+		}
+		logger.Infof("recording upstream traffic into %s", *recordDir)
+	}
+	if *replayDir != "" {
+		r, err := loadReplay(*replayDir)
+		if err != nil {
+			return err
+		}
+		replayer = r
+		logger.Infof("replaying %d responses from %s", r.count, *replayDir)
+	}
+	return nil
+}
+
+// Wrap returns a RoundTripper which records or replays according to the
+// flags, or rt itself if neither is enabled.
+func Wrap(rt http.RoundTripper) http.RoundTripper {
+	if replayer != nil {
+		return &replayFallback{replayer: replayer, fallback: rt}
+	}
+	if *recordDir != "" {
+		return &recordTransport{dir: *recordDir, rt: rt}
+	}
+	return rt
+}
+
+func splitList(s string) []string {
+	var result []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+type recordTransport struct {
+	dir string
+	rt  http.RoundTripper
+}
+
+func (t *recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return t.rt.RoundTrip(req)
+	}
+	name := fmt.Sprintf("%s-%06d", time.Now().Format("20060102-150405"),
+		atomic.AddInt64(&seq, 1))
+	base := filepath.Join(t.dir, name)
+	if req.Body != nil && req.Body != http.NoBody {
+		f, err := os.Create(base + reqBodySuffix)
+		if err != nil {
+			logger.Errorf("[record] create file failed, err: %s", err)
+		} else {
+			req.Body = &teeBody{ReadCloser: req.Body, f: f}
+		}
+	}
+	e := &entry{
+		Method:    req.Method,
+		URL:       req.URL.String(),
+		ReqHeader: req.Header.Clone(),
+		Time:      time.Now(),
+	}
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	e.StatusCode = resp.StatusCode
+	e.RespHeader = resp.Header.Clone()
+	e.HeaderLatency = time.Since(e.Time).Milliseconds()
+	f, err := os.Create(base + respBodySuffix)
+	if err != nil {
+		logger.Errorf("[record] create file failed, err: %s", err)
+		return resp, nil
+	}
+	resp.Body = &teeBody{
+		ReadCloser: resp.Body,
+		f:          f,
+		onClose: func(complete bool) {
+			e.Complete = complete
+			e.RespTrailer = resp.Trailer
+			writeEntry(base+metaSuffix, e)
+		},
+	}
+	return resp, nil
+}
+
+func writeEntry(path string, e *entry) {
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err == nil {
+		err = os.WriteFile(path, data, 0644)
+	}
+	if err != nil {
+		logger.Errorf("[record] write %s failed, err: %s", path, err)
+	}
+}
+
+// teeBody copies everything read from the body into a file.
+type teeBody struct {
+	io.ReadCloser
+	f       *os.File
+	once    sync.Once
+	eof     bool
+	onClose func(complete bool)
+}
+
+func (b *teeBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if _, wErr := b.f.Write(p[:n]); wErr != nil {
+			logger.Errorf("[record] write %s failed, err: %s", b.f.Name(), wErr)
+		}
+	}
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+func (b *teeBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		b.f.Close()
+		if b.onClose != nil {
+			b.onClose(b.eof)
+		}
+	})
+	return err
+}
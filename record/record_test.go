@@ -0,0 +1,64 @@
+package record
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordReplay(t *testing.T) {
+	body := strings.Repeat("x", 64*1024)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Test", r.URL.Query().Get("v"))
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	rt := &recordTransport{dir: dir, rt: http.DefaultTransport}
+	get := func(rt http.RoundTripper, query string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/a?"+query, nil)
+		resp, err := rt.RoundTrip(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := get(rt, "v=1&__t=100")
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, body, string(data))
+
+	// the client disconnects in the middle of the body
+	resp = get(rt, "v=2")
+	io.ReadFull(resp.Body, make([]byte, 10))
+	resp.Body.Close()
+
+	r, err := loadReplay(dir)
+	require.NoError(t, err)
+	assert.Equal(t, 2, r.count)
+
+	// __t is ignored by default
+	resp = get(r, "__t=200&v=1")
+	data, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("X-Test"))
+	assert.Equal(t, body, string(data))
+	assert.Equal(t, int64(len(body)), resp.ContentLength)
+
+	resp = get(r, "v=2")
+	data, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, int64(-1), resp.ContentLength)
+	assert.Empty(t, resp.Header.Get("Content-Length"))
+	assert.Less(t, len(data), len(body))
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/b", nil)
+	_, err = r.RoundTrip(req)
+	assert.Error(t, err)
+}
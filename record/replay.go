@@ -0,0 +1,169 @@
+package record
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zjx20/urlproxy/logger"
+)
+
+type replayTransport struct {
+	mu      sync.Mutex
+	entries map[string][]*replayEntry // match key => entries in recorded order
+	served  map[string]int
+	count   int
+}
+
+type replayEntry struct {
+	*entry
+	bodyPath string
+}
+
+func loadReplay(dir string) (*replayTransport, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+metaSuffix))
+	if err != nil {
+		return nil, err
+	}
+	// file names begin with the recording time
+	sort.Strings(files)
+	r := &replayTransport{
+		entries: map[string][]*replayEntry{},
+		served:  map[string]int{},
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		e := &entry{}
+		if err := json.Unmarshal(data, e); err != nil {
+			return nil, fmt.Errorf("parse %s failed: %w", file, err)
+		}
+		u, err := url.Parse(e.URL)
+		if err != nil {
+			return nil, fmt.Errorf("parse url of %s failed: %w", file, err)
+		}
+		key := matchKey(e.Method, u, e.ReqHeader)
+		r.entries[key] = append(r.entries[key], &replayEntry{
+			entry:    e,
+			bodyPath: strings.TrimSuffix(file, metaSuffix) + respBodySuffix,
+		})
+		r.count++
+	}
+	return r, nil
+}
+
+func matchKey(method string, u *url.URL, header http.Header) string {
+	sb := strings.Builder{}
+	if *replayMatchMethod {
+		sb.WriteString(method)
+		sb.WriteString(" ")
+	}
+	nu := *u
+	query := nu.Query()
+	for _, p := range splitList(*replayIgnoreParams) {
+		query.Del(p)
+	}
+	// Encode() sorts the parameters
+	nu.RawQuery = query.Encode()
+	nu.Fragment = ""
+	sb.WriteString(nu.String())
+	for _, h := range splitList(*replayMatchHeaders) {
+		sb.WriteString("\n")
+		sb.WriteString(http.CanonicalHeaderKey(h))
+		sb.WriteString(": ")
+		sb.WriteString(strings.Join(header.Values(h), ","))
+	}
+	return sb.String()
+}
+
+// next returns the recorded entries one by one if the same request was
+// recorded multiple times, and then repeats the last one.
+func (r *replayTransport) next(key string) *replayEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entries := r.entries[key]
+	if len(entries) == 0 {
+		return nil
+	}
+	idx := r.served[key]
+	if idx >= len(entries) {
+		idx = len(entries) - 1
+	} else {
+		r.served[key] = idx + 1
+	}
+	return entries[idx]
+}
+
+func (r *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	e := r.next(matchKey(req.Method, req.URL, req.Header))
+	if e == nil {
+		logger.Warnf("[replay] no recorded response for %s %s", req.Method, req.URL)
+		return nil, fmt.Errorf("no recorded response for %s %s", req.Method, req.URL)
+	}
+	latency := *replayLatency
+	if *replayRealLatency {
+		latency += time.Duration(e.HeaderLatency) * time.Millisecond
+	}
+	if latency > 0 {
+		t := time.NewTimer(latency)
+		select {
+		case <-t.C:
+		case <-req.Context().Done():
+			t.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+	body, err := os.Open(e.bodyPath)
+	if err != nil {
+		return nil, err
+	}
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode)),
+		StatusCode:    e.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        e.RespHeader.Clone(),
+		Trailer:       e.RespTrailer.Clone(),
+		Body:          body,
+		ContentLength: -1,
+		Request:       req,
+	}
+	if resp.Header == nil {
+		resp.Header = http.Header{}
+	}
+	if !e.Complete {
+		// the recorded body is truncated
+		resp.Header.Del("Content-Length")
+	} else if fi, err := body.Stat(); err == nil {
+		resp.ContentLength = fi.Size()
+	}
+	logger.Debugf("[replay] %s %s, status code: %d", req.Method, req.URL, e.StatusCode)
+	return resp, nil
+}
+
+// replayFallback replays http(s) requests, and serves other schemes (e.g.
+// file and tpl) as usual.
+type replayFallback struct {
+	replayer *replayTransport
+	fallback http.RoundTripper
+}
+
+func (t *replayFallback) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return t.fallback.RoundTrip(req)
+	}
+	return t.replayer.RoundTrip(req)
+}
@@ -0,0 +1,50 @@
+// Package reloaded publishes the values of the flags reloaded from the
+// config file. Flags are only set at startup, a reload publishes a new
+// snapshot instead, so that request goroutines never read a flag while
+// it's being set.
+package reloaded
+
+import (
+	"flag"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	current atomic.Value // map[string]string, flag name => value
+)
+
+// Publish replaces the snapshot, the values override the flags of the same
+// names.
+func Publish(values map[string]string) {
+	current.Store(values)
+}
+
+// Lookup returns the value of the flag in the snapshot, or the value of the
+// flag itself if it's not reloaded.
+func Lookup(name string) string {
+	if m, ok := current.Load().(map[string]string); ok {
+		if v, ok := m[name]; ok {
+			return v
+		}
+	}
+	if f := flag.Lookup(name); f != nil {
+		return f.Value.String()
+	}
+	return ""
+}
+
+func String(name string) string {
+	return Lookup(name)
+}
+
+func Bool(name string) bool {
+	v, _ := strconv.ParseBool(Lookup(name))
+	return v
+}
+
+func Duration(name string) time.Duration {
+	v, _ := time.ParseDuration(Lookup(name))
+	return v
+}
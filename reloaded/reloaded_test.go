@@ -0,0 +1,32 @@
+package reloaded
+
+import (
+	"flag"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublish(t *testing.T) {
+	flag.String("reloaded-test-str", "a", "")
+	flag.Bool("reloaded-test-bool", false, "")
+	flag.Duration("reloaded-test-duration", time.Second, "")
+	defer Publish(nil)
+
+	assert.Equal(t, "a", String("reloaded-test-str"))
+	assert.False(t, Bool("reloaded-test-bool"))
+	assert.Equal(t, time.Second, Duration("reloaded-test-duration"))
+
+	Publish(map[string]string{
+		"reloaded-test-str":      "b",
+		"reloaded-test-bool":     "true",
+		"reloaded-test-duration": "1m",
+	})
+	assert.Equal(t, "b", String("reloaded-test-str"))
+	assert.True(t, Bool("reloaded-test-bool"))
+	assert.Equal(t, time.Minute, Duration("reloaded-test-duration"))
+	// the flags themselves are untouched
+	assert.Equal(t, "a", flag.Lookup("reloaded-test-str").Value.String())
+	assert.Equal(t, "", String("reloaded-test-unknown"))
+}
@@ -0,0 +1,389 @@
+package session
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zjx20/urlproxy/admin"
+	"github.com/zjx20/urlproxy/kvstore"
+	"github.com/zjx20/urlproxy/logger"
+	"golang.org/x/net/publicsuffix"
+)
+
+const namespace = "session"
+
+var (
+	nameRegexp = regexp.MustCompile("^[a-zA-Z0-9_-]+$")
+
+	mu   sync.Mutex
+	jars = map[string]*Jar{} // name => jar
+)
+
+// Cookie is a cookie stored in a jar.
+type Cookie struct {
+	Name     string     `json:"name"`
+	Value    string     `json:"value"`
+	Domain   string     `json:"domain"`
+	Path     string     `json:"path"`
+	HostOnly bool       `json:"hostOnly,omitempty"`
+	Secure   bool       `json:"secure,omitempty"`
+	HttpOnly bool       `json:"httpOnly,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+}
+
+func (c *Cookie) id() string {
+	return c.Domain + ";" + c.Path + ";" + c.Name
+}
+
+func (c *Cookie) expired(now time.Time) bool {
+	return c.Expires != nil && !now.Before(*c.Expires)
+}
+
+func (c *Cookie) matches(u *url.URL, now time.Time) bool {
+	if c.expired(now) {
+		return false
+	}
+	if c.Secure && u.Scheme != "https" {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	if c.HostOnly {
+		if host != c.Domain {
+			return false
+		}
+	} else if !domainMatches(host, c.Domain) {
+		return false
+	}
+	return pathMatches(requestPath(u), c.Path)
+}
+
+// Jar is a named http.CookieJar persisted in the kvstore.
+type Jar struct {
+	name    string
+	mu      sync.Mutex
+	cookies map[string]*Cookie // domain;path;name => cookie
+	updated time.Time
+}
+
+// ValidName tells whether name can be used as a session name.
+func ValidName(name string) bool {
+	return nameRegexp.MatchString(name)
+}
+
+// Get returns the jar of the session, it's loaded from the kvstore or
+// created on the first use. Sessions are kept in memory if the kvstore is
+// unavailable.
+func Get(name string) (*Jar, error) {
+	if !ValidName(name) {
+		return nil, fmt.Errorf("bad session name %s", name)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if jar, ok := jars[name]; ok {
+		return jar, nil
+	}
+	jar, _ := loadLocked(name)
+	jars[name] = jar
+	return jar, nil
+}
+
+// lookup returns the jar of an existing session, without creating it.
+func lookup(name string) (*Jar, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	if jar, ok := jars[name]; ok {
+		return jar, true
+	}
+	return loadLocked(name)
+}
+
+// loadLocked reads the jar from the kvstore, an empty jar is returned if
+// it's not stored. The caller must hold mu.
+func loadLocked(name string) (*Jar, bool) {
+	jar := &Jar{
+		name:    name,
+		cookies: map[string]*Cookie{},
+	}
+	data, err := kvstore.Read(namespace, name)
+	if err != nil {
+		return jar, false
+	}
+	var stored struct {
+		Cookies []*Cookie `json:"cookies"`
+		Updated time.Time `json:"updated"`
+	}
+	if err := json.Unmarshal([]byte(data), &stored); err != nil {
+		logger.Warnf("load session %s failed, err: %s", name, err)
+	}
+	for _, c := range stored.Cookies {
+		jar.cookies[c.id()] = c
+	}
+	jar.updated = stored.Updated
+	return jar, true
+}
+
+// SetCookies implements http.CookieJar.
+func (j *Jar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	if len(cookies) == 0 {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	host := strings.ToLower(u.Hostname())
+	for _, hc := range cookies {
+		c := &Cookie{
+			Name:     hc.Name,
+			Value:    hc.Value,
+			Domain:   host,
+			Path:     hc.Path,
+			HostOnly: true,
+			Secure:   hc.Secure,
+			HttpOnly: hc.HttpOnly,
+		}
+		if hc.Domain != "" {
+			domain := strings.ToLower(strings.TrimPrefix(hc.Domain, "."))
+			if !validDomain(host, domain) {
+				logger.Debugf("session %s: drop cookie %s for domain %s from %s",
+					j.name, hc.Name, domain, host)
+				continue
+			}
+			// a cookie for a public suffix is only accepted from the suffix
+			// itself, as a host-only cookie (RFC 6265 section 5.3)
+			if host != domain {
+				c.Domain = domain
+				c.HostOnly = false
+			}
+		}
+		if !strings.HasPrefix(c.Path, "/") {
+			c.Path = defaultPath(u)
+		}
+		if hc.MaxAge < 0 {
+			delete(j.cookies, c.id())
+			continue
+		}
+		if hc.MaxAge > 0 {
+			exp := now.Add(time.Duration(hc.MaxAge) * time.Second)
+			c.Expires = &exp
+		} else if !hc.Expires.IsZero() {
+			exp := hc.Expires
+			c.Expires = &exp
+		}
+		if c.expired(now) {
+			delete(j.cookies, c.id())
+			continue
+		}
+		j.cookies[c.id()] = c
+	}
+	j.updated = now
+	j.save()
+}
+
+// Cookies implements http.CookieJar.
+func (j *Jar) Cookies(u *url.URL) []*http.Cookie {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	var matched []*Cookie
+	for _, c := range j.cookies {
+		if c.matches(u, now) {
+			matched = append(matched, c)
+		}
+	}
+	// longer paths are listed first
+	sort.Slice(matched, func(i, k int) bool {
+		if len(matched[i].Path) != len(matched[k].Path) {
+			return len(matched[i].Path) > len(matched[k].Path)
+		}
+		return matched[i].Name < matched[k].Name
+	})
+	var result []*http.Cookie
+	for _, c := range matched {
+		result = append(result, &http.Cookie{Name: c.Name, Value: c.Value})
+	}
+	return result
+}
+
+// list returns unexpired cookies, the caller must hold j.mu.
+func (j *Jar) list() []*Cookie {
+	now := time.Now()
+	result := []*Cookie{}
+	for _, c := range j.cookies {
+		if !c.expired(now) {
+			result = append(result, c)
+		}
+	}
+	sort.Slice(result, func(i, k int) bool {
+		return result[i].id() < result[k].id()
+	})
+	return result
+}
+
+// save writes the jar into the kvstore, the caller must hold j.mu.
+func (j *Jar) save() {
+	data, err := json.Marshal(map[string]any{
+		"cookies": j.list(),
+		"updated": j.updated,
+	})
+	if err != nil {
+		logger.Errorf("marshal session %s failed, err: %s", j.name, err)
+		return
+	}
+	if err := kvstore.Write(namespace, j.name, string(data)); err != nil {
+		logger.Debugf("save session %s failed, err: %s", j.name, err)
+	}
+}
+
+// validDomain tells whether the host can set cookies for the domain. The
+// domain must not be a public suffix, e.g. "com" or "co.uk", unless it's
+// the host itself, and IP addresses only set cookies for themselves.
+func validDomain(host string, domain string) bool {
+	if host == domain {
+		return true
+	}
+	if net.ParseIP(host) != nil || !domainMatches(host, domain) {
+		return false
+	}
+	suffix, _ := publicsuffix.PublicSuffix(domain)
+	return suffix != domain
+}
+
+func domainMatches(host string, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+func requestPath(u *url.URL) string {
+	if u.Path == "" {
+		return "/"
+	}
+	return u.Path
+}
+
+func pathMatches(reqPath string, cookiePath string) bool {
+	if reqPath == cookiePath {
+		return true
+	}
+	if !strings.HasPrefix(reqPath, cookiePath) {
+		return false
+	}
+	return strings.HasSuffix(cookiePath, "/") || reqPath[len(cookiePath)] == '/'
+}
+
+// defaultPath returns the directory of the request path, see RFC 6265
+// section 5.1.4.
+func defaultPath(u *url.URL) string {
+	p := requestPath(u)
+	i := strings.LastIndex(p, "/")
+	if i <= 0 {
+		return "/"
+	}
+	return p[:i]
+}
+
+// Summary describes a session.
+type Summary struct {
+	Name    string    `json:"name"`
+	Cookies int       `json:"cookies"`
+	Updated time.Time `json:"updated"`
+}
+
+// List returns the sessions in memory and in the kvstore, sorted by name.
+func List() []*Summary {
+	names := map[string]bool{}
+	if keys, err := kvstore.Keys(namespace); err == nil {
+		for _, name := range keys {
+			names[name] = true
+		}
+	}
+	mu.Lock()
+	for name := range jars {
+		names[name] = true
+	}
+	mu.Unlock()
+	result := []*Summary{}
+	for name := range names {
+		jar, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		jar.mu.Lock()
+		result = append(result, &Summary{
+			Name:    name,
+			Cookies: len(jar.list()),
+			Updated: jar.updated,
+		})
+		jar.mu.Unlock()
+	}
+	sort.Slice(result, func(i, k int) bool {
+		return result[i].Name < result[k].Name
+	})
+	return result
+}
+
+// Clear removes all cookies of the session. The jar in memory is emptied
+// while holding its lock, so that a concurrent SetCookies either happens
+// before and is cleared, or happens after and is kept.
+func Clear(name string) error {
+	if !ValidName(name) {
+		return fmt.Errorf("bad session name %s", name)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if jar, ok := jars[name]; ok {
+		jar.mu.Lock()
+		defer jar.mu.Unlock()
+		// the jar is kept, it may be used by in-flight requests
+		jar.cookies = map[string]*Cookie{}
+		jar.updated = time.Now()
+	}
+	if err := kvstore.Delete(namespace, name); err != nil && err != kvstore.ErrUnavailable {
+		logger.Debugf("delete session %s failed, err: %s", name, err)
+	}
+	return nil
+}
+
+func writeError(w http.ResponseWriter, statusCode int, err error) {
+	admin.WriteJSON(w, statusCode, map[string]string{"error": err.Error()})
+}
+
+// ServeSessions lists sessions for GET, or the cookies of the session
+// specified by "name". DELETE clears the session specified by "name".
+func ServeSessions(w http.ResponseWriter, req *http.Request) {
+	name := req.FormValue("name")
+	switch req.Method {
+	case http.MethodGet:
+		if name == "" {
+			admin.WriteJSON(w, http.StatusOK, List())
+			return
+		}
+		if !ValidName(name) {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("bad session name %s", name))
+			return
+		}
+		jar, ok := lookup(name)
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("session %s not found", name))
+			return
+		}
+		jar.mu.Lock()
+		cookies := jar.list()
+		jar.mu.Unlock()
+		admin.WriteJSON(w, http.StatusOK, cookies)
+	case http.MethodDelete:
+		if err := Clear(name); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,87 @@
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func names(cookies []*http.Cookie) []string {
+	var result []string
+	for _, c := range cookies {
+		result = append(result, c.Name+"="+c.Value)
+	}
+	return result
+}
+
+func TestJar(t *testing.T) {
+	jar, err := Get("test")
+	require.NoError(t, err)
+	defer Clear("test")
+	_, err = Get("bad/name")
+	assert.Error(t, err)
+
+	u, _ := url.Parse("https://www.example.com/account/login")
+	jar.SetCookies(u, []*http.Cookie{
+		{Name: "sid", Value: "1"},
+		{Name: "domain", Value: "2", Domain: ".example.com", Path: "/"},
+		{Name: "secure", Value: "3", Path: "/", Secure: true},
+		{Name: "other", Value: "4", Domain: "other.com"},
+		{Name: "suffix", Value: "5", Domain: "com"},
+	})
+	ip, _ := url.Parse("http://10.0.0.1/")
+	jar.SetCookies(ip, []*http.Cookie{{Name: "ip", Value: "6", Domain: "0.0.1"}})
+
+	get := func(raw string) []string {
+		u, _ := url.Parse(raw)
+		return names(jar.Cookies(u))
+	}
+	assert.Equal(t, []string{"sid=1", "domain=2", "secure=3"}, get("https://www.example.com/account/info"))
+	assert.Equal(t, []string{"domain=2"}, get("http://api.example.com/"))
+	assert.Equal(t, []string{"domain=2"}, get("http://www.example.com/accounts"))
+	assert.Empty(t, get("https://other.com/"))
+	assert.Empty(t, get("http://1.0.0.1/"))
+
+	// deleted by Max-Age
+	jar.SetCookies(u, []*http.Cookie{{Name: "domain", Domain: "example.com", Path: "/", MaxAge: -1}})
+	assert.Empty(t, get("http://api.example.com/"))
+
+	// shared by name
+	same, _ := Get("test")
+	assert.Same(t, jar, same)
+	assert.Equal(t, 2, List()[0].Cookies)
+}
+
+func TestServeSessions(t *testing.T) {
+	get := func(name string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		ServeSessions(rec, httptest.NewRequest(http.MethodGet, "/sessions?name="+name, nil))
+		return rec
+	}
+	assert.Equal(t, http.StatusNotFound, get("none").Code)
+	assert.Equal(t, http.StatusBadRequest, get("bad.name").Code)
+	for _, s := range List() {
+		assert.NotEqual(t, "none", s.Name)
+	}
+
+	jar, err := Get("serve")
+	require.NoError(t, err)
+	u, _ := url.Parse("http://example.com/")
+	jar.SetCookies(u, []*http.Cookie{{Name: "sid", Value: "1"}})
+	rec := get("serve")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"sid"`)
+
+	rec = httptest.NewRecorder()
+	ServeSessions(rec, httptest.NewRequest(http.MethodDelete, "/sessions?name=serve", nil))
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Empty(t, jar.Cookies(u))
+	// the jar in use keeps working after being cleared
+	jar.SetCookies(u, []*http.Cookie{{Name: "sid", Value: "2"}})
+	same, _ := Get("serve")
+	assert.Equal(t, []string{"sid=2"}, names(same.Cookies(u)))
+}
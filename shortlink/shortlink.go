@@ -0,0 +1,271 @@
+package shortlink
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zjx20/urlproxy/admin"
+	"github.com/zjx20/urlproxy/kvstore"
+	"github.com/zjx20/urlproxy/logger"
+	"github.com/zjx20/urlproxy/urlopts"
+)
+
+// Prefix is the path prefix of short links.
+const Prefix = "/s/"
+
+const (
+	namespace = "shortlink"
+	idLength  = 6
+	idChars   = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+)
+
+var (
+	idRegexp = regexp.MustCompile("^[a-zA-Z0-9_-]+$")
+
+	// guards the read-modify-write of hit counters
+	mu sync.Mutex
+
+	ErrConflict = fmt.Errorf("short link already exists")
+)
+
+// Link is a stored short link.
+type Link struct {
+	Id      string     `json:"id"`
+	URL     string     `json:"url"`
+	Created time.Time  `json:"created"`
+	Expires *time.Time `json:"expires,omitempty"`
+	Hits    int64      `json:"hits"`
+	// Trusted links are created with -admin-token, only they are accepted
+	// in the require-signed mode.
+	Trusted bool `json:"trusted"`
+}
+
+func (l *Link) expired() bool {
+	return l.Expires != nil && time.Now().After(*l.Expires)
+}
+
+func load(id string) (*Link, error) {
+	data, err := kvstore.Read(namespace, id)
+	if err != nil {
+		return nil, err
+	}
+	l := &Link{}
+	if err := json.Unmarshal([]byte(data), l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func save(l *Link) error {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return kvstore.Write(namespace, l.Id, string(data))
+}
+
+func randomId() (string, error) {
+	sb := strings.Builder{}
+	for i := 0; i < idLength; i++ {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(idChars))))
+		if err != nil {
+			return "", err
+		}
+		sb.WriteByte(idChars[n.Int64()])
+	}
+	return sb.String(), nil
+}
+
+// validate checks that raw is a urlproxied url, e.g. "/httpbin.org/get".
+func validate(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "" || u.Host != "" || !strings.HasPrefix(u.Path, "/") {
+		return fmt.Errorf("url should be a urlproxied url, e.g. /httpbin.org/get")
+	}
+	_, _, report := urlopts.ExtractWithReport(u)
+	if len(report.Errors) > 0 {
+		var errs []string
+		for _, e := range report.Errors {
+			errs = append(errs, e.String())
+		}
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Create stores the urlproxied url under the id, a random id is generated
+// if id is empty. ErrConflict is returned if the id is taken by a link that
+// hasn't expired. The link never expires if ttl is 0.
+func Create(id string, raw string, ttl time.Duration, trusted bool) (*Link, error) {
+	if err := validate(raw); err != nil {
+		return nil, err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if id == "" {
+		for {
+			var err error
+			if id, err = randomId(); err != nil {
+				return nil, err
+			}
+			if _, err := load(id); err != nil {
+				break
+			}
+		}
+	} else if !idRegexp.MatchString(id) {
+		return nil, fmt.Errorf("bad id %s", id)
+	} else if l, err := load(id); err == nil && !l.expired() {
+		return nil, ErrConflict
+	}
+	l := &Link{
+		Id:      id,
+		URL:     raw,
+		Created: time.Now(),
+		Trusted: trusted,
+	}
+	if ttl > 0 {
+		exp := l.Created.Add(ttl)
+		l.Expires = &exp
+	}
+	if err := save(l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// hit returns the link and increases its hit counter. Expired links are
+// deleted.
+func hit(id string) (*Link, error) {
+	if !idRegexp.MatchString(id) {
+		return nil, fmt.Errorf("bad id %s", id)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	l, err := load(id)
+	if err != nil {
+		return nil, err
+	}
+	if l.expired() {
+		kvstore.Delete(namespace, id)
+		return nil, fmt.Errorf("short link %s expired", id)
+	}
+	l.Hits++
+	if err := save(l); err != nil {
+		logger.Warnf("update hits of short link %s failed, err: %s", id, err)
+	}
+	return l, nil
+}
+
+// List returns all links sorted by id, expired links are deleted.
+func List() ([]*Link, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	ids, err := kvstore.Keys(namespace)
+	if err != nil {
+		return nil, err
+	}
+	result := []*Link{}
+	for _, id := range ids {
+		l, err := load(id)
+		if err != nil {
+			logger.Warnf("load short link %s failed, err: %s", id, err)
+			continue
+		}
+		if l.expired() {
+			kvstore.Delete(namespace, id)
+			continue
+		}
+		result = append(result, l)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Id < result[j].Id
+	})
+	return result, nil
+}
+
+func Delete(id string) error {
+	if !idRegexp.MatchString(id) {
+		return fmt.Errorf("bad id %s", id)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return kvstore.Delete(namespace, id)
+}
+
+// Expand is a handler.Expander for short links.
+func Expand(w http.ResponseWriter, req *http.Request, rest string) (*url.URL, bool, bool) {
+	l, err := hit(rest)
+	if err != nil {
+		logger.Debugf("expand short link %s failed, err: %s", rest, err)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("short link not found"))
+		return nil, false, false
+	}
+	u, err := url.Parse(l.URL)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return nil, false, false
+	}
+	return u, l.Trusted, true
+}
+
+func writeError(w http.ResponseWriter, statusCode int, err error) {
+	admin.WriteJSON(w, statusCode, map[string]string{"error": err.Error()})
+}
+
+// ServeLinks lists links for GET, creates a link for POST with the "url",
+// and the optional "id" and "ttl" parameters, and deletes the link specified
+// by "id" for DELETE.
+func ServeLinks(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		links, err := List()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, links)
+	case http.MethodPost:
+		var ttl time.Duration
+		if v := req.FormValue("ttl"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			ttl = d
+		}
+		// the request has passed the admin token if it's set, otherwise it
+		// comes from a loopback address without authentication
+		l, err := Create(req.FormValue("id"), req.FormValue("url"), ttl, admin.TokenSet())
+		if err == ErrConflict {
+			writeError(w, http.StatusConflict, err)
+			return
+		} else if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, l)
+	case http.MethodDelete:
+		if err := Delete(req.FormValue("id")); err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
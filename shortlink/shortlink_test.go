@@ -0,0 +1,89 @@
+package shortlink
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zjx20/urlproxy/kvstore"
+)
+
+func TestCreateExpand(t *testing.T) {
+	require.NoError(t, kvstore.InitKVStore(t.TempDir(), 0))
+	defer kvstore.Close()
+
+	_, err := Create("", "http://example.com/", 0, false)
+	assert.Error(t, err)
+	_, err = Create("bad/id", "/example.com/", 0, false)
+	assert.Error(t, err)
+
+	l, err := Create("", "/uOptScheme=https/example.com/a?b=c", 0, false)
+	require.NoError(t, err)
+	assert.Len(t, l.Id, idLength)
+
+	_, err = Create("live", "/example.com/live.m3u8", 0, true)
+	require.NoError(t, err)
+	_, err = Create("live", "/example.com/other.m3u8", 0, true)
+	assert.Equal(t, ErrConflict, err)
+
+	rec := httptest.NewRecorder()
+	u, trusted, ok := Expand(rec, httptest.NewRequest(http.MethodGet, "/s/live", nil), "live")
+	require.True(t, ok)
+	assert.True(t, trusted)
+	assert.Equal(t, "/example.com/live.m3u8", u.String())
+	_, trusted, ok = Expand(rec, httptest.NewRequest(http.MethodGet, "/", nil), l.Id)
+	assert.True(t, ok)
+	assert.False(t, trusted)
+
+	rec = httptest.NewRecorder()
+	_, _, ok = Expand(rec, httptest.NewRequest(http.MethodGet, "/s/none", nil), "none")
+	assert.False(t, ok)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	// an expired link can be replaced
+	_, err = Create("old", "/example.com/", time.Nanosecond, false)
+	require.NoError(t, err)
+	time.Sleep(time.Millisecond)
+	_, err = Create("old", "/example.com/new", 0, false)
+	require.NoError(t, err)
+
+	links, err := List()
+	require.NoError(t, err)
+	require.Len(t, links, 3)
+	for _, l := range links {
+		if l.Id == "live" {
+			assert.Equal(t, int64(1), l.Hits)
+		}
+	}
+	require.NoError(t, Delete("live"))
+	_, err = hit("live")
+	assert.Error(t, err)
+}
+
+func TestServeLinks(t *testing.T) {
+	require.NoError(t, kvstore.InitKVStore(t.TempDir(), 0))
+	defer kvstore.Close()
+
+	post := func(form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/links", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		ServeLinks(rec, req)
+		return rec
+	}
+	form := url.Values{"id": {"a"}, "url": {"/example.com/"}}
+	assert.Equal(t, http.StatusOK, post(form).Code)
+	assert.Equal(t, http.StatusConflict, post(form).Code)
+	form.Set("ttl", "bad")
+	form.Set("id", "b")
+	assert.Equal(t, http.StatusBadRequest, post(form).Code)
+
+	rec := httptest.NewRecorder()
+	ServeLinks(rec, httptest.NewRequest(http.MethodDelete, "/links?id=a", nil))
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+}
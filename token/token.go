@@ -0,0 +1,342 @@
+package token
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/zjx20/urlproxy/admin"
+	"github.com/zjx20/urlproxy/logger"
+	"github.com/zjx20/urlproxy/urlopts"
+)
+
+var (
+	key           = flag.String("token-key", "", "Secret key for signing and encrypting token urls (/t/<token>)")
+	ttl           = flag.Duration("token-ttl", 0, "Default lifetime of minted tokens, 0 means never expire")
+	encrypt       = flag.Bool("token-encrypt", false, "Encrypt minted tokens by default, so that the target and options are not visible")
+	requireSigned = flag.Bool("require-signed", false, "Refuse urls that are not token urls, except the admin endpoints")
+	mintToken     = flag.String("mint-token", "", "Print the token url for the given urlproxied url and exit")
+)
+
+// Prefix is the path prefix of token urls.
+const Prefix = "/t/"
+
+const (
+	versionSigned    = 1
+	versionEncrypted = 2
+
+	macSize = 16
+)
+
+var (
+	headerInternal = http.CanonicalHeaderKey("X-Urlproxy-Internal")
+	internalSecret = newInternalSecret()
+
+	ErrBadToken = fmt.Errorf("bad token")
+	ErrExpired  = fmt.Errorf("token expired")
+)
+
+// payload is the content of a token.
+type payload struct {
+	URL     string   `json:"u"`
+	Options []string `json:"o,omitempty"`
+	Expires int64    `json:"e,omitempty"` // unix seconds
+}
+
+func newInternalSecret() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func deriveKey(purpose string) []byte {
+	m := hmac.New(sha256.New, []byte(*key))
+	m.Write([]byte(purpose))
+	return m.Sum(nil)
+}
+
+func sign(data []byte) []byte {
+	m := hmac.New(sha256.New, deriveKey("sign"))
+	m.Write(data)
+	return m.Sum(nil)[:macSize]
+}
+
+func newGCM() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(deriveKey("encrypt"))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Init checks the flags. In the require-signed mode, urls relocated by
+// urlopts.RelocateToUrlproxy(), e.g. the rewritten redirects and HLS
+// playlists, are turned into token urls too.
+func Init() error {
+	if (*requireSigned || *mintToken != "") && *key == "" {
+		return fmt.Errorf("-token-key is required")
+	}
+	if *requireSigned && !admin.TokenSet() {
+		// otherwise tokens could be minted by /_urlproxy/tokens
+		return fmt.Errorf("-admin-token is required by -require-signed")
+	}
+	if *requireSigned {
+		urlopts.SetRelocateHook(relocate)
+		logger.Infof("only signed urls are accepted")
+	}
+	return nil
+}
+
+// MintFromFlag prints the token url for -mint-token, it returns false if
+// the flag is not set.
+func MintFromFlag() (bool, error) {
+	if *mintToken == "" {
+		return false, nil
+	}
+	t, err := Mint(*mintToken, *ttl, *encrypt)
+	if err != nil {
+		return true, err
+	}
+	fmt.Println(Prefix + t)
+	return true, nil
+}
+
+// Enabled tells whether token urls are accepted.
+func Enabled() bool {
+	return *key != ""
+}
+
+// Required tells whether only token urls are accepted.
+func Required() bool {
+	return *requireSigned
+}
+
+// normalize splits a urlproxied url, or an absolute url with uOpt*
+// parameters, into the target url and the options.
+func normalize(raw string) (*url.URL, *urlopts.Options, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	after, opts := urlopts.Extract(u)
+	if after.Scheme == "" {
+		after.Scheme = "http"
+		if scheme, ok := urlopts.OptScheme.ValueFrom(opts); ok {
+			after.Scheme = strings.ToLower(scheme)
+		}
+		host, ok := urlopts.OptHost.ValueFrom(opts)
+		if !ok && !urlopts.OptUpstream.ExistsIn(opts) && urlopts.HasHost(after.Scheme) {
+			return nil, nil, fmt.Errorf("no target host in %s", raw)
+		}
+		after.Host = host
+	}
+	opts.Remove(urlopts.OptScheme)
+	opts.Remove(urlopts.OptHost)
+	return &after, opts, nil
+}
+
+// Mint returns the token for the urlproxied url. The token never expires
+// if ttl is 0.
+func Mint(raw string, ttl time.Duration, encrypted bool) (string, error) {
+	if *key == "" {
+		return "", fmt.Errorf("-token-key is not set")
+	}
+	target, opts, err := normalize(raw)
+	if err != nil {
+		return "", err
+	}
+	p := payload{
+		URL:     target.String(),
+		Options: urlopts.ToList(opts),
+	}
+	if ttl > 0 {
+		p.Expires = time.Now().Add(ttl).Unix()
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+	var buf []byte
+	if encrypted {
+		gcm, err := newGCM()
+		if err != nil {
+			return "", err
+		}
+		nonce := make([]byte, gcm.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return "", err
+		}
+		buf = append([]byte{versionEncrypted}, nonce...)
+		// the version byte is authenticated as additional data
+		buf = gcm.Seal(buf, nonce, data, buf[:1])
+	} else {
+		buf = append([]byte{versionSigned}, data...)
+		buf = append(buf, sign(buf)...)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func decode(t string) (*payload, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(t)
+	if err != nil || len(buf) == 0 {
+		return nil, ErrBadToken
+	}
+	var data []byte
+	switch buf[0] {
+	case versionSigned:
+		if len(buf) < 1+macSize {
+			return nil, ErrBadToken
+		}
+		body, mac := buf[:len(buf)-macSize], buf[len(buf)-macSize:]
+		if subtle.ConstantTimeCompare(mac, sign(body)) != 1 {
+			return nil, ErrBadToken
+		}
+		data = body[1:]
+	case versionEncrypted:
+		gcm, err := newGCM()
+		if err != nil {
+			return nil, err
+		}
+		if len(buf) < 1+gcm.NonceSize() {
+			return nil, ErrBadToken
+		}
+		nonce := buf[1 : 1+gcm.NonceSize()]
+		data, err = gcm.Open(nil, nonce, buf[1+gcm.NonceSize():], buf[:1])
+		if err != nil {
+			return nil, ErrBadToken
+		}
+	default:
+		return nil, ErrBadToken
+	}
+	p := &payload{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, ErrBadToken
+	}
+	if p.Expires > 0 && time.Now().Unix() > p.Expires {
+		return nil, ErrExpired
+	}
+	return p, nil
+}
+
+// Resolve verifies the token, and returns the urlproxied url it carries.
+func Resolve(t string) (*url.URL, error) {
+	if *key == "" {
+		return nil, fmt.Errorf("token urls are disabled")
+	}
+	p, err := decode(t)
+	if err != nil {
+		return nil, err
+	}
+	target, err := url.Parse(p.URL)
+	if err != nil {
+		return nil, ErrBadToken
+	}
+	opts, err := urlopts.ParseList(p.Options)
+	if err != nil {
+		return nil, ErrBadToken
+	}
+	// not by urlopts.RelocateToUrlproxy(), which may turn it into a token
+	// url again in the require-signed mode.
+	opts.Set(urlopts.OptScheme.New(target.Scheme))
+	opts.Set(urlopts.OptHost.New(target.Host))
+	u, err := url.Parse("/" + urlopts.SortedOptionPath(opts) + target.EscapedPath())
+	if err != nil {
+		return nil, ErrBadToken
+	}
+	u.RawQuery = target.RawQuery
+	return u, nil
+}
+
+// Expand is a handler.Expander for token urls.
+func Expand(w http.ResponseWriter, req *http.Request, rest string) (*url.URL, bool, bool) {
+	u, err := Resolve(rest)
+	if err != nil {
+		logger.Warnf("resolve token failed, err: %s", err)
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(err.Error()))
+		return nil, false, false
+	}
+	return u, true, true
+}
+
+// relocate turns a relocated url into a token url.
+func relocate(u *url.URL) *url.URL {
+	// vhost urls are minted in the path style, the token url is relative so
+	// that it works under any host of urlproxy.
+	t, err := Mint(urlopts.DevhostURL(u).String(), *ttl, *encrypt)
+	if err != nil {
+		logger.Errorf("mint token for %s failed, err: %s", u, err)
+		return u
+	}
+	return &url.URL{Path: Prefix + t}
+}
+
+// MarkInternal marks a request sent by urlproxy to itself, which is
+// accepted in the require-signed mode.
+func MarkInternal(req *http.Request) {
+	req.Header.Set(headerInternal, internalSecret)
+}
+
+// TakeInternal tells whether the request is marked by MarkInternal(), the
+// mark is removed so that it won't be forwarded.
+func TakeInternal(req *http.Request) bool {
+	v := req.Header.Get(headerInternal)
+	if v == "" {
+		return false
+	}
+	req.Header.Del(headerInternal)
+	return subtle.ConstantTimeCompare([]byte(v), []byte(internalSecret)) == 1
+}
+
+type mintResult struct {
+	Token   string     `json:"token"`
+	Path    string     `json:"path"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// ServeMint mints a token for the "url" parameter. The "ttl" and "encrypt"
+// parameters override -token-ttl and -token-encrypt.
+func ServeMint(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	lifetime := *ttl
+	if v := q.Get("ttl"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			admin.WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		lifetime = d
+	}
+	encrypted := *encrypt
+	if v := q.Get("encrypt"); v != "" {
+		encrypted = v == "true" || v == "1"
+	}
+	t, err := Mint(q.Get("url"), lifetime, encrypted)
+	if err != nil {
+		admin.WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	result := mintResult{
+		Token: t,
+		Path:  Prefix + t,
+	}
+	if lifetime > 0 {
+		exp := time.Now().Add(lifetime)
+		result.Expires = &exp
+	}
+	admin.WriteJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,69 @@
+package token
+
+import (
+	"flag"
+	"testing"
+	"time"
+
+	"github.com/zjx20/urlproxy/admin"
+	"github.com/zjx20/urlproxy/urlopts"
+)
+
+func TestMintResolve(t *testing.T) {
+	*key = "secret"
+	defer func() { *key = "" }()
+
+	for _, encrypted := range []bool{false, true} {
+		tk, err := Mint("/uOptScheme=https/uOptHeader=Authorization:Bearer%20x/example.com/a/b?c=d", 0, encrypted)
+		if err != nil {
+			t.Fatalf("mint failed, err: %s", err)
+		}
+		u, err := Resolve(tk)
+		if err != nil {
+			t.Fatalf("resolve failed, err: %s", err)
+		}
+		expected := "/uOptHeader=Authorization:Bearer%20x/uOptHost=example.com/uOptScheme=https/a/b?c=d"
+		if u.String() != expected {
+			t.Errorf("expected %s, got %s", expected, u.String())
+		}
+
+		tampered := []byte(tk)
+		tampered[len(tampered)/2] ^= 1
+		if _, err := Resolve(string(tampered)); err != ErrBadToken {
+			t.Errorf("expected ErrBadToken for tampered token, got %v", err)
+		}
+	}
+
+	tk, err := Mint("http://example.com/", time.Hour, false)
+	if err != nil {
+		t.Fatalf("mint failed, err: %s", err)
+	}
+	if _, err := Resolve(tk); err != nil {
+		t.Errorf("resolve failed, err: %s", err)
+	}
+	*key = "another"
+	if _, err := Resolve(tk); err != ErrBadToken {
+		t.Errorf("expected ErrBadToken for another key, got %v", err)
+	}
+}
+
+func TestInitRequireSigned(t *testing.T) {
+	*key = "secret"
+	*requireSigned = true
+	defer func() {
+		*key = ""
+		*requireSigned = false
+		flag.Set("admin-token", "")
+		admin.Reload()
+		urlopts.SetRelocateHook(nil)
+	}()
+
+	if err := Init(); err == nil {
+		t.Errorf("expected an error without -admin-token")
+	}
+	flag.Set("admin-token", "admin")
+	admin.Reload()
+	if err := Init(); err != nil {
+		t.Errorf("init failed, err: %s", err)
+	}
+}
@@ -10,16 +10,19 @@ import (
 	"text/template"
 	"time"
 
+	"github.com/zjx20/urlproxy/session"
 	"github.com/zjx20/urlproxy/urlopts"
 )
 
 func Funcs() template.FuncMap {
 	return template.FuncMap{
-		"httpReq":       httpReq,
-		"tryHttpReq":    tryHttpReq,
-		"httpHeader":    httpHeader,
-		"parseUrl":      parseUrl,
-		"urlproxiedUrl": urlproxiedUrl,
+		"httpReq":           httpReq,
+		"tryHttpReq":        tryHttpReq,
+		"sessionHttpReq":    sessionHttpReq,
+		"trySessionHttpReq": trySessionHttpReq,
+		"httpHeader":        httpHeader,
+		"parseUrl":          parseUrl,
+		"urlproxiedUrl":     urlproxiedUrl,
 	}
 }
 
@@ -31,6 +34,24 @@ func tryHttpReq(ctx context.Context, method string, url string, body string,
 
 func httpReq(ctx context.Context, method string, url string, body string,
 	header *HeaderWrapper, timeoutSec int) (*ResponseWrapper, error) {
+	return doHttpReq(ctx, "", method, url, body, header, timeoutSec)
+}
+
+func trySessionHttpReq(ctx context.Context, sessionName string, method string,
+	url string, body string, header *HeaderWrapper, timeoutSec int) *ResponseWrapper {
+	resp, _ := sessionHttpReq(ctx, sessionName, method, url, body, header, timeoutSec)
+	return resp
+}
+
+// sessionHttpReq is httpReq with the cookie jar of the session, which is
+// shared with the requests proxied with uOptSession.
+func sessionHttpReq(ctx context.Context, sessionName string, method string,
+	url string, body string, header *HeaderWrapper, timeoutSec int) (*ResponseWrapper, error) {
+	return doHttpReq(ctx, sessionName, method, url, body, header, timeoutSec)
+}
+
+func doHttpReq(ctx context.Context, sessionName string, method string, url string,
+	body string, header *HeaderWrapper, timeoutSec int) (*ResponseWrapper, error) {
 	if ctx == nil {
 		ctx = context.Background()
 	}
@@ -46,9 +67,16 @@ func httpReq(ctx context.Context, method string, url string, body string,
 		}
 	}
 	client := http.DefaultClient
-	if timeout > 0 {
+	if timeout > 0 || sessionName != "" {
 		client = &http.Client{Timeout: timeout}
 	}
+	if sessionName != "" {
+		jar, err := session.Get(sessionName)
+		if err != nil {
+			return nil, err
+		}
+		client.Jar = jar
+	}
 	resp, err := client.Do(req)
 	return &ResponseWrapper{resp, err}, err
 }
@@ -3,41 +3,106 @@ package urlopts
 import (
 	"fmt"
 	"net/http"
+	"sort"
+	"strconv"
+	"time"
 )
 
 var (
 	options = map[string]Option{}
+	infos   = map[string]*OptionInfo{}
+	aliases = map[string]alias{} // name => alias
 )
 
+// alias is an option in another type, which is converted into its target
+// option after parsing, e.g. uOptTimeout=1.5s is uOptTimeoutMs=1500.
+type alias struct {
+	target  string
+	convert func(o Option) string
+}
+
+// OptionInfo describes a defined option.
+type OptionInfo struct {
+	Name        string   `json:"name"`
+	Type        string   `json:"type"`
+	Description string   `json:"description"`
+	Choices     []string `json:"choices,omitempty"`
+	AliasOf     string   `json:"aliasOf,omitempty"`
+	// internal options are generated by urlproxy itself
+	Internal bool `json:"internal"`
+}
+
 var (
-	OptHost            = defineStringOption("Host")
-	OptHeader          = defineHeaderOption("Header")
-	OptRespHeader      = defineHeaderOption("RespHeader")
-	OptScheme          = defineStringOption("Scheme")
-	OptQueryParams     = defineStringOption("QueryParams")
-	OptSocks           = defineStringOption("Socks")
-	OptDns             = defineStringOption("Dns")
-	OptIp              = defineStringOption("Ip")
-	OptTimeoutMs       = defineInt64Option("TimeoutMs")
-	OptRetriesNon2xx   = defineInt64Option("RetriesNon2xx")
-	OptRetriesError    = defineInt64Option("RetriesError")
-	OptAntiCaching     = defineBoolOption("AntiCaching")
-	OptRaceMode        = defineInt64Option("RaceMode")
-	OptRewriteRedirect = defineBoolOption("RewriteRedirect")
-	OptPipe            = defineStringOption("Pipe")
-
-	OptHLSBoost      = defineBoolOption("HLSBoost")
-	OptHLSPrefetches = defineInt64Option("HLSPrefetches")
-	OptHLSTimeoutMs  = defineInt64Option("HLSTimeoutMs")
-	OptHLSShortUrl   = defineBoolOption("HLSShortUrl")
-	OptHLSPlaylist   = defineStringOption("HLSPlaylist") // internal
-	OptHLSUser       = defineStringOption("HLSUser")     // internal
-	OptHLSSegment    = defineStringOption("HLSSegment")  // internal
-
-	OptAntPieceSize        = defineInt64Option("AntPieceSize")
-	OptAntConcurrentPieces = defineInt64Option("AntConcurrentPieces")
+	OptHost              = defineStringOption("Host", "Host of the target url")
+	OptHeader            = defineHeaderOption("Header", "Extra header for the proxied request, in the form of Key:Value, the value can reference variables like ${req.host}")
+	OptRespHeader        = defineHeaderOption("RespHeader", "Extra header for the response, in the form of Key:Value, the value can reference variables like ${resp.header.X}")
+	OptDelHeader         = defineListOption("DelHeader", "Headers removed from the proxied request, globs like X-Forwarded-* are supported")
+	OptDelRespHeader     = defineListOption("DelRespHeader", "Headers removed from the response, globs like X-Forwarded-* are supported")
+	OptScheme            = defineStringOption("Scheme", "Scheme of the target url, e.g. https, file or tpl, h2c/grpc and h2/grpcs are proxied over HTTP/2")
+	OptUpstream          = defineStringOption("Upstream", "Name of the upstream group in the config file, instead of uOptHost")
+	OptLbPolicy          = defineEnumOption("LbPolicy", "Load balancing policy of the inline upstream group in uOptHost, e.g. a.com,b.com", "round-robin", "least-conn", "hash")
+	OptQueryParams       = defineStringOption("QueryParams", "Extra query parameters for the proxied request")
+	OptSocks             = defineStringOption("Socks", "Upstream socks5 proxy, \"off\" to disable")
+	OptDns               = defineStringOption("Dns", "DNS server for resolving the target host")
+	OptIp                = defineStringOption("Ip", "IP address of the target host")
+	OptBindIp            = defineStringOption("BindIp", "Source address of upstream connections, requests rotate through comma-separated addresses")
+	OptBindIface         = defineStringOption("BindIface", "Network interface of upstream connections (SO_BINDTODEVICE), Linux only")
+	OptIpFamily          = defineEnumOption("IpFamily", "Address family of upstream connections", "ipv4", "ipv6", "prefer-ipv4", "prefer-ipv6")
+	OptHttpVersion       = defineEnumOption("HttpVersion", "HTTP version of upstream requests, 2 is HTTP/2 over TLS and h2c is cleartext HTTP/2, negotiated by default", "1.1", "2", "h2c")
+	OptKeepAlive         = defineBoolOption("KeepAlive", "Reuse upstream connections, false closes the connection after each request")
+	OptIdleConnTimeoutMs = defineInt64Option("IdleConnTimeoutMs", "Idle upstream connections are closed after the milliseconds, defaults to -idle-conn-timeout")
+	OptIdleConnTimeout   = defineDurationOption("IdleConnTimeout", "Alias of uOptIdleConnTimeoutMs in duration, e.g. 30s")
+	OptMaxConnsPerHost   = defineInt64Option("MaxConnsPerHost", "Max upstream connections per host, 0 means no limit, defaults to -max-conns-per-host")
+	OptTimeoutMs         = defineInt64Option("TimeoutMs", "Timeout of the request in milliseconds, including retries")
+	OptTimeout           = defineDurationOption("Timeout", "Alias of uOptTimeoutMs in duration, e.g. 1.5s")
+	OptConnectTimeoutMs  = defineInt64Option("ConnectTimeoutMs", "Timeout of connecting to the target in milliseconds, for each attempt")
+	OptConnectTimeout    = defineDurationOption("ConnectTimeout", "Alias of uOptConnectTimeoutMs in duration, e.g. 3s")
+	OptHeaderTimeoutMs   = defineInt64Option("HeaderTimeoutMs", "Timeout of receiving the response header in milliseconds, for each attempt")
+	OptHeaderTimeout     = defineDurationOption("HeaderTimeout", "Alias of uOptHeaderTimeoutMs in duration, e.g. 10s")
+	OptIdleTimeoutMs     = defineInt64Option("IdleTimeoutMs", "Max milliseconds without any progress while transferring the body")
+	OptIdleTimeout       = defineDurationOption("IdleTimeout", "Alias of uOptIdleTimeoutMs in duration, e.g. 30s")
+	OptFlushMs           = defineInt64Option("FlushMs", "Flush the response to the client at the interval in milliseconds, 0 flushes every write, -1 never flushes")
+	OptFlush             = defineDurationOption("Flush", "Alias of uOptFlushMs in duration, e.g. 100ms")
+	OptRetriesNon2xx     = defineInt64Option("RetriesNon2xx", "Number of retries for non-2xx responses")
+	OptRetriesError      = defineInt64Option("RetriesError", "Number of retries for errors")
+	OptAntiCaching       = defineBoolOption("AntiCaching", "Add the __t parameter with the current time to the url")
+	OptRaceMode          = defineInt64Option("RaceMode", "Number of identical requests sent simultaneously, at most 5")
+	OptStaleIfError      = defineDurationOption("StaleIfError", "Serve the last successful response not older than the duration if the request fails or gets 5xx, e.g. 10m")
+	OptCoalesce          = defineBoolOption("Coalesce", "Share one upstream request among identical concurrent GET and HEAD requests, defaults to -coalesce")
+	OptBypassBreaker     = defineBoolOption("BypassBreaker", "Send the request even if the circuit breaker of the target host is open, e.g. for health probes")
+	OptRewriteRedirect   = defineBoolOption("RewriteRedirect", "Rewrite the Location of redirects to urlproxy")
+	OptRewriteCookies    = defineBoolOption("RewriteCookies", "Scope cookies of the target under urlproxy, and namespace their names by the target host")
+	OptSession           = defineStringOption("Session", "Name of the persistent cookie jar for upstream requests")
+	OptCors              = defineBoolOption("Cors", "Answer CORS preflights locally, add CORS headers to responses, and rewrite Origin/Referer to the target")
+	OptPipe              = defineStringOption("Pipe", "Shell script for processing the response body, requires -enable-uoptpipe")
+	OptProfile           = defineStringOption("Profile", "Name of the option profile in the config file")
+	OptExplain           = defineBoolOption("Explain", "Respond how the url would be handled, instead of proxying it")
+	OptStrict            = defineBoolOption("Strict", "Respond 400 if there is any unknown or invalid option")
+
+	OptHLSBoost      = defineBoolOption("HLSBoost", "Enable HLSBoost for the m3u8 playlist")
+	OptHLSPrefetches = defineInt64Option("HLSPrefetches", "Number of segments downloaded concurrently by HLSBoost")
+	OptHLSTimeoutMs  = defineInt64Option("HLSTimeoutMs", "Timeout of fetching playlists and segments in milliseconds")
+	OptHLSTimeout    = defineDurationOption("HLSTimeout", "Alias of uOptHLSTimeoutMs in duration, e.g. 5s")
+	OptHLSShortUrl   = defineBoolOption("HLSShortUrl", "Generate short segment urls in the playlist")
+	OptHLSPlaylist   = defineStringOption("HLSPlaylist", "Playlist id of HLSBoost") // internal
+	OptHLSUser       = defineStringOption("HLSUser", "User id of HLSBoost")         // internal
+	OptHLSSegment    = defineStringOption("HLSSegment", "Segment id of HLSBoost")   // internal
+
+	OptAntPieceSize        = defineByteSizeOption("AntPieceSize", "Bytes downloaded at once by each thread, e.g. 512KiB")
+	OptAntConcurrentPieces = defineInt64Option("AntConcurrentPieces", "Number of threads for downloading a segment")
 )
 
+func init() {
+	markInternal(OptHLSPlaylist, OptHLSUser, OptHLSSegment)
+	defineAlias(OptTimeout, OptTimeoutMs, durationToMs)
+	defineAlias(OptConnectTimeout, OptConnectTimeoutMs, durationToMs)
+	defineAlias(OptHeaderTimeout, OptHeaderTimeoutMs, durationToMs)
+	defineAlias(OptIdleTimeout, OptIdleTimeoutMs, durationToMs)
+	defineAlias(OptFlush, OptFlushMs, durationToMs)
+	defineAlias(OptIdleConnTimeout, OptIdleConnTimeoutMs, durationToMs)
+	defineAlias(OptHLSTimeout, OptHLSTimeoutMs, durationToMs)
+}
+
 //////////////////////////////////////////////////////////////////////////////
 
 type identifier[O Option, V any] struct {
@@ -80,34 +145,116 @@ func (id *identifier[O, V]) ExistsIn(opts *Options) bool {
 	return exists
 }
 
-func addDefinition[O Option, V any](name string, opt O, _ V) identifier[O, V] {
+func addDefinition[O Option, V any](name string, typ string, desc string, opt O, _ V) identifier[O, V] {
 	id := identifier[O, V]{
 		name: name,
 	}
 	options[id.name] = opt
+	infos[id.name] = &OptionInfo{
+		Name:        UrlOptionPrefix + name,
+		Type:        typ,
+		Description: desc,
+	}
 	return id
 }
 
-func defineInt64Option(name string) identifier[*Int64Option, int64] {
+func durationToMs(o Option) string {
+	return strconv.FormatInt(o.ObscureValue().(time.Duration).Milliseconds(), 10)
+}
+
+func defineAlias(id, target interface{ Name() string }, convert func(o Option) string) {
+	aliases[id.Name()] = alias{
+		target:  target.Name(),
+		convert: convert,
+	}
+	infos[id.Name()].AliasOf = UrlOptionPrefix + target.Name()
+}
+
+// resolveAliases converts aliases into their target options. The target
+// option takes precedence if both are present.
+func resolveAliases(opts *Options, report *Report) {
+	for name, a := range aliases {
+		v, ok := opts.optMap.LoadAndDelete(name)
+		if !ok || !v.(Option).IsPresent() {
+			continue
+		}
+		if _, exists := opts.optMap.Load(a.target); exists {
+			continue
+		}
+		target := newOption(a.target)
+		value := a.convert(v.(Option))
+		if err := target.Parse(value); err != nil {
+			report.addError(UrlOptionPrefix+name, value, err.Error())
+			continue
+		}
+		opts.Set(target)
+	}
+}
+
+func markInternal(ids ...interface{ Name() string }) {
+	for _, id := range ids {
+		infos[id.Name()].Internal = true
+	}
+}
+
+// Registry returns all defined options sorted by name.
+func Registry() []OptionInfo {
+	result := make([]OptionInfo, 0, len(infos))
+	for _, info := range infos {
+		result = append(result, *info)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+func defineInt64Option(name string, desc string) identifier[*Int64Option, int64] {
 	o := &Int64Option{}
 	o.name = name
-	return addDefinition(name, o, o.Value())
+	return addDefinition(name, "int64", desc, o, o.Value())
 }
 
-func defineStringOption(name string) identifier[*StringOption, string] {
+func defineStringOption(name string, desc string) identifier[*StringOption, string] {
 	o := &StringOption{}
 	o.name = name
-	return addDefinition(name, o, o.Value())
+	return addDefinition(name, "string", desc, o, o.Value())
 }
 
-func defineHeaderOption(name string) identifier[*HeaderOption, http.Header] {
+func defineHeaderOption(name string, desc string) identifier[*HeaderOption, http.Header] {
 	o := &HeaderOption{}
 	o.name = name
-	return addDefinition(name, o, o.Value())
+	return addDefinition(name, "header", desc, o, o.Value())
+}
+
+func defineDurationOption(name string, desc string) identifier[*DurationOption, time.Duration] {
+	o := &DurationOption{}
+	o.name = name
+	return addDefinition(name, "duration", desc, o, o.Value())
+}
+
+func defineByteSizeOption(name string, desc string) identifier[*ByteSizeOption, int64] {
+	o := &ByteSizeOption{}
+	o.name = name
+	return addDefinition(name, "bytesize", desc, o, o.Value())
+}
+
+func defineEnumOption(name string, desc string, choices ...string) identifier[*EnumOption, string] {
+	o := &EnumOption{choices: choices}
+	o.name = name
+	id := addDefinition(name, "enum", desc, o, o.Value())
+	infos[name].Choices = choices
+	return id
+}
+
+func defineListOption(name string, desc string) identifier[*ListOption, []string] {
+	o := &ListOption{}
+	o.name = name
+	return addDefinition(name, "list", desc, o, o.Value())
 }
 
-func defineBoolOption(name string) identifier[*BoolOption, bool] {
+func defineBoolOption(name string, desc string) identifier[*BoolOption, bool] {
 	o := &BoolOption{}
 	o.name = name
-	return addDefinition(name, o, o.Value())
+	return addDefinition(name, "bool", desc, o, o.Value())
 }
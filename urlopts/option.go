@@ -2,13 +2,21 @@ package urlopts
 
 import (
 	"fmt"
+	"math"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
-const UrlOptionPrefix = "uOpt"
+const (
+	UrlOptionPrefix = "uOpt"
+	// HeaderOptionPrefix is the prefix of the (canonicalized) request headers
+	// carrying options.
+	HeaderOptionPrefix = "X-Urlproxy-Opt-"
+)
 
 type Option interface {
 	Name() string
@@ -194,3 +202,170 @@ func (o *BoolOption) Clone() Option {
 	co := *o
 	return &co
 }
+
+//////////////////////////////////////////////////////////////////////////////
+
+type DurationOption struct {
+	OptionBase[time.Duration]
+}
+
+func (o *DurationOption) Parse(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	o.Set(v)
+	return nil
+}
+
+func (o *DurationOption) ToUrlOption() []string {
+	return []string{o.urlOptionKey() + o.Value().String()}
+}
+
+func (o *DurationOption) Clone() Option {
+	co := *o
+	return &co
+}
+
+//////////////////////////////////////////////////////////////////////////////
+
+var (
+	byteSizeRegexp = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)\s*([a-zA-Z]*)$`)
+	byteSizeUnits  = map[string]int64{
+		"":    1,
+		"b":   1,
+		"k":   1000,
+		"kb":  1000,
+		"kib": 1 << 10,
+		"m":   1000 * 1000,
+		"mb":  1000 * 1000,
+		"mib": 1 << 20,
+		"g":   1000 * 1000 * 1000,
+		"gb":  1000 * 1000 * 1000,
+		"gib": 1 << 30,
+	}
+	// units for ToUrlOption(), from the largest one
+	byteSizeFormatUnits = []struct {
+		name string
+		size int64
+	}{
+		{"GiB", 1 << 30},
+		{"MiB", 1 << 20},
+		{"KiB", 1 << 10},
+	}
+)
+
+// ByteSizeOption is a number of bytes, e.g. "1048576", "512KiB" or "1.5MB".
+type ByteSizeOption struct {
+	OptionBase[int64]
+}
+
+func (o *ByteSizeOption) Parse(s string) error {
+	m := byteSizeRegexp.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return fmt.Errorf("invalid byte size: %s", s)
+	}
+	unit, ok := byteSizeUnits[strings.ToLower(m[2])]
+	if !ok {
+		return fmt.Errorf("invalid byte size unit: %s", m[2])
+	}
+	if !strings.Contains(m[1], ".") {
+		v, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return err
+		}
+		if v > math.MaxInt64/unit {
+			return fmt.Errorf("byte size overflows: %s", s)
+		}
+		o.Set(v * unit)
+		return nil
+	}
+	v, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return err
+	}
+	// float64(math.MaxInt64) is rounded up to 1<<63
+	if size := v * float64(unit); size >= float64(math.MaxInt64) {
+		return fmt.Errorf("byte size overflows: %s", s)
+	}
+	o.Set(int64(v * float64(unit)))
+	return nil
+}
+
+func (o *ByteSizeOption) ToUrlOption() []string {
+	v := o.Value()
+	for _, u := range byteSizeFormatUnits {
+		if v != 0 && v%u.size == 0 {
+			return []string{o.urlOptionKey() + strconv.FormatInt(v/u.size, 10) + u.name}
+		}
+	}
+	return []string{o.urlOptionKey() + strconv.FormatInt(v, 10)}
+}
+
+func (o *ByteSizeOption) Clone() Option {
+	co := *o
+	return &co
+}
+
+//////////////////////////////////////////////////////////////////////////////
+
+// EnumOption is a string from fixed choices, case-insensitive.
+type EnumOption struct {
+	OptionBase[string]
+	choices []string
+}
+
+func (o *EnumOption) Parse(s string) error {
+	for _, c := range o.choices {
+		if strings.EqualFold(c, s) {
+			o.Set(c)
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid value: %s, should be one of %s",
+		s, strings.Join(o.choices, ", "))
+}
+
+func (o *EnumOption) ToUrlOption() []string {
+	return []string{o.urlOptionKey() + url.PathEscape(o.Value())}
+}
+
+func (o *EnumOption) Clone() Option {
+	co := *o
+	return &co
+}
+
+//////////////////////////////////////////////////////////////////////////////
+
+// ListOption is a list of strings. It can be given multiple times, and each
+// value can be comma-separated, e.g. "a,b" is the same as "a" and "b".
+type ListOption struct {
+	OptionBase[[]string]
+}
+
+func (o *ListOption) Parse(s string) error {
+	v := o.Value()
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			v = append(v, item)
+		}
+	}
+	o.Set(v)
+	return nil
+}
+
+func (o *ListOption) ToUrlOption() []string {
+	var result []string
+	for _, item := range o.Value() {
+		result = append(result, o.urlOptionKey()+url.PathEscape(item))
+	}
+	return result
+}
+
+func (o *ListOption) Clone() Option {
+	co := *o
+	if v := o.Value(); v != nil {
+		co.Set(append([]string{}, v...))
+	}
+	return &co
+}
@@ -0,0 +1,151 @@
+package urlopts
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// presets are options configured globally, see ApplyPresets().
+type presets struct {
+	defaults *Options
+	profiles map[string]*Options
+}
+
+var (
+	currentPresets atomic.Value // *presets
+)
+
+// SetPresets replaces the global default options and the named profiles.
+func SetPresets(defaults *Options, profiles map[string]*Options) {
+	if defaults == nil {
+		defaults = &Options{}
+	}
+	currentPresets.Store(&presets{
+		defaults: defaults,
+		profiles: profiles,
+	})
+}
+
+// Presets returns the global default options and the named profiles.
+func Presets() (defaults *Options, profiles map[string]*Options) {
+	p, ok := currentPresets.Load().(*presets)
+	if !ok {
+		return &Options{}, nil
+	}
+	return p.defaults, p.profiles
+}
+
+// ApplyPresets merges the profile specified by uOptProfile, and then the
+// global default options into opts. Options that are already present in
+// opts take precedence. The merged options are trusted, see TrustedHeader().
+func ApplyPresets(opts *Options) error {
+	defaults, profiles := Presets()
+	if name, ok := OptProfile.ValueFrom(opts); ok {
+		profile, exists := profiles[name]
+		if !exists {
+			return fmt.Errorf("unknown profile %s", name)
+		}
+		opts.merge(profile, true)
+	}
+	opts.merge(defaults, true)
+	return nil
+}
+
+// ParseList parses options in the form of "uOptXXX=value", the value is
+// unescaped like the options in the path. Unlike Extract(), it reports
+// errors for unknown or invalid options.
+func ParseList(items []string) (*Options, error) {
+	opts := &Options{}
+	for _, item := range items {
+		ok, rest := extractOptionName(item)
+		if !ok {
+			return nil, fmt.Errorf("%q: should start with %s", item, UrlOptionPrefix)
+		}
+		parts := strings.SplitN(rest, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q: should be in the form of %sName=value",
+				item, UrlOptionPrefix)
+		}
+		name, value := parts[0], pathUnescaped(parts[1])
+		opt, exists := opts.optMap.Load(name)
+		if !exists {
+			opt = newOption(name)
+			if opt == nil {
+				return nil, fmt.Errorf("%q: unknown option %s%s", item, UrlOptionPrefix, name)
+			}
+		}
+		if err := opt.(Option).Parse(value); err != nil {
+			return nil, fmt.Errorf("%q: %w", item, err)
+		}
+		opts.Set(opt.(Option))
+	}
+	report := &Report{}
+	resolveAliases(opts, report)
+	if len(report.Errors) > 0 {
+		return nil, fmt.Errorf("%s", report.Errors[0])
+	}
+	return opts, nil
+}
+
+// Merge sets options from src which are absent in opts. For header options,
+// the missing keys are merged. The merged parts are remembered, so that
+// RelocateToUrlproxy() leaves them out.
+func (opts *Options) Merge(src *Options) {
+	opts.merge(src, false)
+}
+
+// merge is Merge(), the merged parts are also marked as trusted if the
+// source is trusted.
+func (opts *Options) merge(src *Options, trusted bool) {
+	src.optMap.Range(func(key, value any) bool {
+		o := value.(Option)
+		if !o.IsPresent() {
+			return true
+		}
+		var part Option
+		existing, exists := opts.optMap.Load(key)
+		if !exists || !existing.(Option).IsPresent() {
+			opts.optMap.Store(key, o.Clone())
+			part = o
+		} else if dst, ok := existing.(*HeaderOption); ok {
+			headers := dst.Value()
+			added := http.Header{}
+			for k, values := range o.(*HeaderOption).Value() {
+				if _, exists := headers[k]; !exists {
+					headers[k] = append([]string{}, values...)
+					added[k] = headers[k]
+				}
+			}
+			if len(added) > 0 {
+				h := o.Clone().(*HeaderOption)
+				h.Set(added)
+				part = h
+			}
+		}
+		if part != nil {
+			addPart(&opts.merged, key, part)
+			if trusted {
+				addPart(&opts.trusted, key, part)
+			}
+		}
+		return true
+	})
+}
+
+// addPart remembers a part of an option in m, the keys of header options
+// are accumulated.
+func addPart(m *sync.Map, key any, part Option) {
+	if h, ok := part.(*HeaderOption); ok {
+		if existing, ok := m.Load(key); ok {
+			headers := existing.(*HeaderOption).Value()
+			for k, values := range h.Value() {
+				headers[k] = append([]string{}, values...)
+			}
+			return
+		}
+	}
+	m.Store(key, part.Clone())
+}
@@ -2,6 +2,7 @@ package urlopts
 
 import (
 	"fmt"
+	"net/http"
 	"net/url"
 	"regexp"
 	"sort"
@@ -17,14 +18,24 @@ var (
 
 type Options struct {
 	optMap sync.Map // name => Option
+	// merged holds the parts merged by Merge(), e.g. from the presets and
+	// the option headers, they are left out of relocated urls.
+	merged sync.Map // name => Option
+	// trusted holds the parts from trusted sources, i.e. the presets and
+	// the signed urls, see Trust().
+	trusted sync.Map // name => Option
 }
 
 func (opts *Options) Set(opt Option) {
 	opts.optMap.Store(opt.Name(), opt)
+	opts.merged.Delete(opt.Name())
+	opts.trusted.Delete(opt.Name())
 }
 
 func (opts *Options) Remove(id interface{ Name() string }) {
 	opts.optMap.Delete(id.Name())
+	opts.merged.Delete(id.Name())
+	opts.trusted.Delete(id.Name())
 }
 
 func (opts *Options) Clone() *Options {
@@ -33,6 +44,71 @@ func (opts *Options) Clone() *Options {
 		clone.optMap.Store(key, value.(Option).Clone())
 		return true
 	})
+	opts.merged.Range(func(key, value any) bool {
+		clone.merged.Store(key, value.(Option).Clone())
+		return true
+	})
+	opts.trusted.Range(func(key, value any) bool {
+		clone.trusted.Store(key, value.(Option).Clone())
+		return true
+	})
+	return clone
+}
+
+// Trust marks all the options in opts as from a trusted source, e.g. a
+// signed url.
+func (opts *Options) Trust() {
+	opts.optMap.Range(func(key, value any) bool {
+		if value.(Option).IsPresent() {
+			opts.trusted.Store(key, value.(Option).Clone())
+		}
+		return true
+	})
+}
+
+// Untrusted tells whether the option is present and not from a trusted
+// source, i.e. it's chosen by the client.
+func (opts *Options) Untrusted(id interface{ Name() string }) bool {
+	o, ok := opts.optMap.Load(id.Name())
+	if !ok || !o.(Option).IsPresent() {
+		return false
+	}
+	_, trusted := opts.trusted.Load(id.Name())
+	return !trusted
+}
+
+// TrustedHeader returns the headers of a header option which are from
+// trusted sources, see Trust() and ApplyPresets().
+func (opts *Options) TrustedHeader(id interface{ Name() string }) http.Header {
+	if t, ok := opts.trusted.Load(id.Name()); ok {
+		if h, ok := t.(*HeaderOption); ok {
+			return h.Value()
+		}
+	}
+	return nil
+}
+
+// unmerged returns a copy of opts without the parts merged by Merge().
+func (opts *Options) unmerged() *Options {
+	clone := &Options{}
+	opts.optMap.Range(func(key, value any) bool {
+		o := value.(Option).Clone()
+		if m, ok := opts.merged.Load(key); ok {
+			h, isHeader := o.(*HeaderOption)
+			if !isHeader {
+				return true
+			}
+			headers := h.Value()
+			for k := range m.(*HeaderOption).Value() {
+				delete(headers, k)
+			}
+			if len(headers) == 0 {
+				return true
+			}
+		}
+		clone.optMap.Store(key, o)
+		return true
+	})
 	return clone
 }
 
@@ -59,6 +135,20 @@ func (opts *Options) String() string {
 	return sb.String()
 }
 
+// newOptionFold is newOption() but case-insensitive, for the option names
+// from canonicalized header keys.
+func newOptionFold(name string) Option {
+	if o := newOption(name); o != nil {
+		return o
+	}
+	for k := range options {
+		if strings.EqualFold(k, name) {
+			return newOption(k)
+		}
+	}
+	return nil
+}
+
 func newOption(name string) Option {
 	o := options[name]
 	if o == nil {
@@ -67,12 +157,54 @@ func newOption(name string) Option {
 	return o.Clone()
 }
 
-func conv(uopts url.Values) *Options {
+// Report describes how Extract() parsed a url.
+type Report struct {
+	PathOptions  []string `json:"pathOptions"`
+	QueryOptions []string `json:"queryOptions"`
+	HostFromPath string   `json:"hostFromPath,omitempty"`
+	// Vhost is the target host decided by the Host header.
+	Vhost string `json:"vhost,omitempty"`
+	// HeaderOptions are the options from X-Urlproxy-Opt-* headers.
+	HeaderOptions []string `json:"headerOptions,omitempty"`
+	// Errors are the options dropped for being unknown or invalid.
+	Errors []*OptionError `json:"errors,omitempty"`
+}
+
+// OptionError describes an unknown or invalid option.
+type OptionError struct {
+	Option string `json:"option"`
+	Value  string `json:"value,omitempty"`
+	Error  string `json:"error"`
+}
+
+func (e *OptionError) String() string {
+	if e.Value == "" {
+		return e.Option + ": " + e.Error
+	}
+	return fmt.Sprintf("%s=%s: %s", e.Option, e.Value, e.Error)
+}
+
+func (r *Report) sortErrors() {
+	sort.SliceStable(r.Errors, func(i, j int) bool {
+		return r.Errors[i].Option < r.Errors[j].Option
+	})
+}
+
+func (r *Report) addError(option string, value string, err string) {
+	r.Errors = append(r.Errors, &OptionError{
+		Option: option,
+		Value:  value,
+		Error:  err,
+	})
+}
+
+func conv(uopts url.Values, report *Report) *Options {
 	opts := &Options{}
 	for k, values := range uopts {
 		opt := newOption(k)
 		if opt == nil {
 			logger.Warnf("unknown option %s", k)
+			report.addError(UrlOptionPrefix+k, "", "unknown option")
 			continue
 		}
 		ok := true
@@ -81,14 +213,53 @@ func conv(uopts url.Values) *Options {
 			if err != nil {
 				logger.Errorf("parse option %s failed, input: %s, error: %s",
 					k, value, err)
+				report.addError(UrlOptionPrefix+k, value, err.Error())
+				ok = false
+				break
+			}
+		}
+		if ok {
+			opts.Set(opt)
+		}
+	}
+	report.sortErrors()
+	return opts
+}
+
+// TakeFromHeader extracts options from the headers like
+// "X-Urlproxy-Opt-Socks: off", the headers are removed so that they won't be
+// forwarded.
+func TakeFromHeader(header http.Header, report *Report) *Options {
+	opts := &Options{}
+	for k, values := range header {
+		if !strings.HasPrefix(k, HeaderOptionPrefix) {
+			continue
+		}
+		header.Del(k)
+		name := k[len(HeaderOptionPrefix):]
+		opt := newOptionFold(name)
+		if opt == nil {
+			logger.Warnf("unknown option header %s", k)
+			report.addError(k, "", "unknown option")
+			continue
+		}
+		ok := true
+		for _, value := range values {
+			if err := opt.Parse(value); err != nil {
+				logger.Errorf("parse option header %s failed, input: %s, error: %s",
+					k, value, err)
+				report.addError(k, value, err.Error())
 				ok = false
 				break
 			}
+			report.HeaderOptions = append(report.HeaderOptions, k+": "+value)
 		}
 		if ok {
 			opts.Set(opt)
 		}
 	}
+	resolveAliases(opts, report)
+	report.sortErrors()
 	return opts
 }
 
@@ -112,6 +283,31 @@ func setRawPath(u *url.URL, rawPath string) {
 }
 
 func Extract(u *url.URL) (after url.URL, opts *Options) {
+	after, opts, _ = ExtractWithReport(u)
+	return
+}
+
+// ExtractWithReport is the same as Extract(), besides it reports where the
+// options came from, and the options that were dropped.
+func ExtractWithReport(u *url.URL) (after url.URL, opts *Options, report *Report) {
+	return extract(u, nil)
+}
+
+// ExtractRequest is the same as ExtractWithReport() on r.URL, besides in the
+// vhost mode, the target is decided by the Host header of the request.
+func ExtractRequest(r *http.Request) (after url.URL, opts *Options, report *Report) {
+	var vh *Vhost
+	if r.URL.Scheme == "" {
+		vh = resolveVhost(r.Host)
+	}
+	return extract(r.URL, vh)
+}
+
+func extract(u *url.URL, vh *Vhost) (after url.URL, opts *Options, report *Report) {
+	report = &Report{
+		PathOptions:  []string{},
+		QueryOptions: []string{},
+	}
 	// Some of the http servers have strict request verification, even the
 	// order of query parameters is not allowed to change. So we can't extract
 	// url options by using u.Query() and query.Encode(), which can change the
@@ -125,6 +321,7 @@ func Extract(u *url.URL) (after url.URL, opts *Options) {
 		rm := match[0]
 		if ok, oName := extractOptionName(k); ok {
 			uopts.Add(oName, v)
+			report.QueryOptions = append(report.QueryOptions, match[2])
 		}
 		rawQuery = strings.ReplaceAll(rawQuery, rm, "")
 	}
@@ -153,21 +350,33 @@ func Extract(u *url.URL) (after url.URL, opts *Options) {
 			if pos != -1 {
 				_, oName := extractOptionName(seg[:pos])
 				uopts.Add(oName, pathUnescaped(seg[next:]))
+				report.PathOptions = append(report.PathOptions, seg)
 				continue
 			}
 		}
 		filtered = append(filtered, seg)
 	}
-	// extract the first segment of the path as the host.
+	// extract the first segment of the path as the host, unless the target
+	// is an upstream group.
 	// but if u.Scheme != "", the url is for a regular http proxy request,
 	// so it's not a urlproxied url.
-	if !uopts.Has(OptHost.name) && u.Scheme == "" {
+	if !uopts.Has(OptHost.name) && u.Scheme == "" && vh != nil {
+		uopts.Set(OptHost.name, vh.host)
+		if !uopts.Has(OptScheme.name) {
+			uopts.Set(OptScheme.name, vh.scheme)
+		}
+		if vh.Profile != "" && !uopts.Has(OptProfile.name) {
+			uopts.Set(OptProfile.name, vh.Profile)
+		}
+		report.Vhost = vh.host
+	} else if !uopts.Has(OptHost.name) && !uopts.Has(OptUpstream.name) && u.Scheme == "" {
 		scheme := strings.ToLower(uopts.Get(OptScheme.name))
-		if scheme == "" || scheme == "http" || scheme == "https" {
+		if scheme == "" || HasHost(scheme) {
 			if len(filtered) > 0 {
 				host := filtered[0]
 				filtered = filtered[1:]
 				uopts.Set(OptHost.name, pathUnescaped(host))
+				report.HostFromPath = pathUnescaped(host)
 			}
 		}
 	}
@@ -179,10 +388,22 @@ func Extract(u *url.URL) (after url.URL, opts *Options) {
 	after = *u
 	after.RawQuery = rawQuery
 	setRawPath(&after, rawPath)
-	opts = conv(uopts)
+	opts = conv(uopts, report)
+	resolveAliases(opts, report)
 	return
 }
 
+// HasHost tells whether the targets of the scheme are network hosts, unlike
+// e.g. file and tpl. Besides http and https, h2c/grpc and h2/grpcs are
+// proxied over HTTP/2 only.
+func HasHost(scheme string) bool {
+	switch scheme {
+	case "http", "https", "h2c", "grpc", "h2", "grpcs":
+		return true
+	}
+	return false
+}
+
 func ToList(opts *Options) []string {
 	var result []string
 	opts.optMap.Range(func(key, value any) bool {
@@ -203,10 +424,32 @@ func SortedOptionPath(opts *Options) string {
 	return strings.Join(list, "/")
 }
 
+var (
+	relocateHook func(u *url.URL) *url.URL
+)
+
+// SetRelocateHook sets a function to post-process the urls returned by
+// RelocateToUrlproxy(). It should be called before serving.
+func SetRelocateHook(fn func(u *url.URL) *url.URL) {
+	relocateHook = fn
+}
+
+// RelocateToUrlproxy converts the url to a url of urlproxy with the options.
+// The options merged from the presets and the option headers are not
+// written into the url, the presets are applied again when the url is
+// requested, and the headers are meant to keep options out of urls.
 func RelocateToUrlproxy(u *url.URL, opts *Options) *url.URL {
-	cloneOpts := opts.Clone()
+	cloneOpts := opts.unmerged()
 
 	if u.Scheme != "" {
+		if vu := relocateToVhost(u, cloneOpts); vu != nil {
+			// the vhost mode
+			*u = *vu
+			if relocateHook != nil {
+				return relocateHook(u)
+			}
+			return u
+		}
 		// it's an absolute url, convert it into a relative url for urlproxy
 		cloneOpts.Set(OptScheme.New(u.Scheme))
 		cloneOpts.Set(OptHost.New(u.Host))
@@ -230,5 +473,8 @@ func RelocateToUrlproxy(u *url.URL, opts *Options) *url.URL {
 			}
 		}
 	}
+	if relocateHook != nil {
+		return relocateHook(u)
+	}
 	return u
 }
@@ -1,8 +1,10 @@
 package urlopts
 
 import (
+	"net/http"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -69,3 +71,196 @@ func TestExtract(t *testing.T) {
 		assert.Equal(t, c.opts, SortedOptionPath(opts), "input: %s", c.input)
 	}
 }
+
+func TestApplyPresets(t *testing.T) {
+	defaults, err := ParseList([]string{
+		"uOptTimeoutMs=5000",
+		"uOptHeader=User-Agent:urlproxy",
+		"uOptHeader=X-Default:yes",
+	})
+	require.NoError(t, err)
+	slow, err := ParseList([]string{"uOptTimeoutMs=60000", "uOptRetriesError=3"})
+	require.NoError(t, err)
+	SetPresets(defaults, map[string]*Options{"slow": slow})
+	defer SetPresets(nil, nil)
+
+	u, _ := url.Parse("/hostname/path?uOptHeader=User-Agent:curl")
+	_, opts := Extract(u)
+	require.NoError(t, ApplyPresets(opts))
+	assert.Equal(t, "uOptHeader=User-Agent:curl/uOptHeader=X-Default:yes/uOptHost=hostname/uOptTimeoutMs=5000",
+		SortedOptionPath(opts))
+	// the presets are left out of relocated urls
+	assert.Equal(t, "/uOptHeader=User-Agent:curl/uOptHost=hostname/x",
+		RelocateToUrlproxy(&url.URL{Path: "/x"}, opts.Clone()).String())
+
+	u, _ = url.Parse("/hostname/path?uOptProfile=slow&uOptTimeoutMs=1000")
+	_, opts = Extract(u)
+	require.NoError(t, ApplyPresets(opts))
+	assert.Equal(t, "uOptHeader=User-Agent:urlproxy/uOptHeader=X-Default:yes/uOptHost=hostname/uOptProfile=slow/uOptRetriesError=3/uOptTimeoutMs=1000",
+		SortedOptionPath(opts))
+	assert.Equal(t, "/uOptHost=hostname/uOptProfile=slow/uOptTimeoutMs=1000/x",
+		RelocateToUrlproxy(&url.URL{Path: "/x"}, opts).String())
+
+	u, _ = url.Parse("/hostname/path?uOptProfile=nonexist")
+	_, opts = Extract(u)
+	assert.Error(t, ApplyPresets(opts))
+
+	_, err = ParseList([]string{"uOptTimeoutMs=abc"})
+	assert.Error(t, err)
+	_, err = ParseList([]string{"uOptNonExistOption=1"})
+	assert.Error(t, err)
+}
+
+func TestTakeFromHeader(t *testing.T) {
+	header := http.Header{}
+	header.Set("X-Urlproxy-Opt-Socks", "off")
+	header.Set("X-Urlproxy-Opt-Timeoutms", "3000")
+	header.Add("X-Urlproxy-Opt-Header", "Foo:bar")
+	header.Add("X-Urlproxy-Opt-Header", "User-Agent:urlproxy")
+	header.Set("X-Urlproxy-Opt-Nonexist", "1")
+	header.Set("Accept", "*/*")
+
+	report := &Report{}
+	headerOpts := TakeFromHeader(header, report)
+	assert.Equal(t, http.Header{"Accept": {"*/*"}}, header)
+	assert.Len(t, report.Errors, 1)
+
+	u, _ := url.Parse("/hostname/path?uOptHeader=User-Agent:curl&uOptTimeoutMs=1000")
+	_, opts := Extract(u)
+	opts.Merge(headerOpts)
+	assert.Equal(t, "uOptHeader=Foo:bar/uOptHeader=User-Agent:curl/uOptHost=hostname/uOptSocks=off/uOptTimeoutMs=1000",
+		SortedOptionPath(opts))
+}
+
+func TestOptionTypes(t *testing.T) {
+	d := &DurationOption{}
+	require.NoError(t, d.Parse("1.5s"))
+	assert.Equal(t, 1500*time.Millisecond, d.Value())
+	assert.Error(t, d.Parse("1.5"))
+
+	b := &ByteSizeOption{}
+	for input, expected := range map[string]int64{
+		"1024":   1024,
+		"512KiB": 512 * 1024,
+		"1.5MB":  1500 * 1000,
+		"2 gib":  2 << 30,
+	} {
+		require.NoError(t, b.Parse(input))
+		assert.Equal(t, expected, b.Value(), input)
+	}
+	assert.Error(t, b.Parse("1PB"))
+	assert.Error(t, b.Parse("9000000000GiB"))
+	assert.Error(t, b.Parse("9223372036854775807KB"))
+	assert.Error(t, b.Parse("8589934592.5GiB"))
+	require.NoError(t, b.Parse("8589934591GiB"))
+	assert.Equal(t, int64(8589934591)<<30, b.Value())
+	require.NoError(t, b.Parse("524288"))
+	b.name = "Size"
+	assert.Equal(t, []string{"uOptSize=512KiB"}, b.ToUrlOption())
+
+	e := &EnumOption{choices: []string{"1.1", "2"}}
+	require.NoError(t, e.Parse("2"))
+	assert.Error(t, e.Parse("3"))
+
+	l := &ListOption{}
+	require.NoError(t, l.Parse("a, b"))
+	require.NoError(t, l.Parse("c"))
+	assert.Equal(t, []string{"a", "b", "c"}, l.Value())
+	cl := l.Clone().(*ListOption)
+	cl.Parse("d")
+	assert.Equal(t, []string{"a", "b", "c"}, l.Value())
+
+	// aliases are converted into their targets, and the round trip of
+	// RelocateToUrlproxy() keeps the values.
+	u, _ := url.Parse("/hostname/path?uOptTimeout=1.5s&uOptAntPieceSize=1MiB")
+	_, opts := Extract(u)
+	assert.Equal(t, "uOptAntPieceSize=1MiB/uOptHost=hostname/uOptTimeoutMs=1500",
+		SortedOptionPath(opts))
+	relocated := RelocateToUrlproxy(&url.URL{Path: "/path"}, opts)
+	_, opts = Extract(relocated)
+	size, _ := OptAntPieceSize.ValueFrom(opts)
+	assert.Equal(t, int64(1<<20), size)
+	timeout, _ := OptTimeoutMs.ValueFrom(opts)
+	assert.Equal(t, int64(1500), timeout)
+
+	u, _ = url.Parse("/hostname/path?uOptTimeout=1s&uOptTimeoutMs=200")
+	_, opts = Extract(u)
+	assert.Equal(t, "uOptHost=hostname/uOptTimeoutMs=200", SortedOptionPath(opts))
+}
+
+func TestVhost(t *testing.T) {
+	require.NoError(t, SetVhosts("https://proxy.example.com:8443", "", map[string]*Vhost{
+		"App.example.net": {Target: "http://app.internal:8080", Profile: "app"},
+	}))
+	defer currentVhosts.Store((*vhosts)(nil))
+
+	assert.Equal(t, "my--site-example-com", encodeVhostLabel("my-site.example.com"))
+	assert.Equal(t, "my-site.example.com", decodeVhostLabel("my--site-example-com"))
+
+	r, _ := http.NewRequest(http.MethodGet, "/path?a=1", nil)
+	r.Host = "app.example.net"
+	_, opts, report := ExtractRequest(r)
+	assert.Equal(t, "app.internal:8080", report.Vhost)
+	assert.Equal(t, "uOptHost=app.internal:8080/uOptProfile=app/uOptScheme=http",
+		SortedOptionPath(opts))
+
+	r.Host = "my--site-example-com.proxy.example.com:8443"
+	_, opts, _ = ExtractRequest(r)
+	assert.Equal(t, "uOptHost=my-site.example.com/uOptScheme=https",
+		SortedOptionPath(opts))
+
+	u, _ := url.Parse("http://www.example.com/a/b?c=d")
+	relocated := RelocateToUrlproxy(u, &Options{})
+	assert.Equal(t, "https://www-example-com.proxy.example.com:8443/uOptScheme=http/a/b?c=d",
+		relocated.String())
+	assert.Equal(t, "/uOptHost=www.example.com/uOptScheme=http/a/b?c=d",
+		DevhostURL(relocated).String())
+
+	u, _ = url.Parse("http://app.internal:8080/x")
+	assert.Equal(t, "https://app.example.net:8443/x", RelocateToUrlproxy(u, &Options{}).String())
+
+	// a redirect from www.example.com, the options of the current request
+	// must not route it back to www.example.com
+	r.Host = "www-example-com.proxy.example.com:8443"
+	_, opts, _ = ExtractRequest(r)
+	opts.Set(OptProfile.New("p"))
+	opts.Set(OptTimeoutMs.New(100))
+	u, _ = url.Parse("https://cdn.example.com/x")
+	relocated = RelocateToUrlproxy(u, opts)
+	assert.Equal(t, "https://cdn-example-com.proxy.example.com:8443/uOptTimeoutMs=100/x",
+		relocated.String())
+	assert.Equal(t, "/uOptHost=cdn.example.com/uOptScheme=https/uOptTimeoutMs=100/x",
+		DevhostURL(relocated).String())
+	u, _ = url.Parse("http://cdn.example.com/y")
+	assert.Equal(t, "https://cdn-example-com.proxy.example.com:8443/uOptScheme=http/uOptTimeoutMs=100/y",
+		RelocateToUrlproxy(u, opts).String())
+	u, _ = url.Parse("http://app.internal:8080/x")
+	assert.Equal(t, "https://app.example.net:8443/uOptTimeoutMs=100/x", RelocateToUrlproxy(u, opts).String())
+	// urls that can't be vhosts keep the profile in the path style
+	u, _ = url.Parse("https://cdn.example.com:444/z")
+	assert.Equal(t, "/uOptHost=cdn.example.com:444/uOptProfile=p/uOptScheme=https/uOptTimeoutMs=100/z",
+		RelocateToUrlproxy(u, opts).String())
+}
+
+func TestRegistry(t *testing.T) {
+	registry := Registry()
+	byName := map[string]OptionInfo{}
+	for i, info := range registry {
+		if i > 0 {
+			assert.Less(t, registry[i-1].Name, info.Name)
+		}
+		byName[info.Name] = info
+	}
+	assert.Equal(t, "int64", byName["uOptTimeoutMs"].Type)
+	assert.Equal(t, "uOptTimeoutMs", byName["uOptTimeout"].AliasOf)
+	assert.Equal(t, []string{"1.1", "2", "h2c"}, byName["uOptHttpVersion"].Choices)
+	assert.True(t, byName["uOptHLSSegment"].Internal)
+	assert.NotEmpty(t, byName["uOptStrict"].Description)
+
+	u, _ := url.Parse("/uOptUnknown=1/hostname/path?uOptTimeoutMs=abc&uOptStrict=true")
+	_, opts, report := ExtractWithReport(u)
+	require.Len(t, report.Errors, 2)
+	assert.False(t, OptTimeoutMs.ExistsIn(opts))
+	strict, _ := OptStrict.ValueFrom(opts)
+	assert.True(t, strict)
+}
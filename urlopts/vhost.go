@@ -0,0 +1,226 @@
+package urlopts
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync/atomic"
+)
+
+// Vhost routes requests for a host name to a target, e.g. requests to
+// "app.example.net" are routed to "https://app.internal.com".
+type Vhost struct {
+	Target  string `yaml:"target"`            // e.g. https://app.internal.com
+	Profile string `yaml:"profile,omitempty"` // optional, name of the option profile
+
+	scheme string
+	host   string
+}
+
+type vhosts struct {
+	base    *url.URL // e.g. https://proxy.example.com
+	profile string   // profile for the encoded vhosts
+	table   map[string]*Vhost
+	reverse map[string]string // scheme://host of the target => vhost name
+}
+
+var (
+	currentVhosts atomic.Value // *vhosts
+)
+
+// SetVhosts enables the vhost mode. base is the public url of urlproxy
+// whose host is the suffix of the encoded vhosts, e.g. with the base
+// "https://proxy.example.com", requests to "www-example-com.proxy.example.com"
+// are routed to "https://www.example.com". The table maps host names to
+// targets directly. The vhost mode is disabled if both are empty.
+func SetVhosts(base string, profile string, table map[string]*Vhost) error {
+	vs, err := newVhosts(base, profile, table)
+	if err != nil {
+		return err
+	}
+	currentVhosts.Store(vs)
+	return nil
+}
+
+// CheckVhosts validates the arguments of SetVhosts without applying them.
+func CheckVhosts(base string, profile string, table map[string]*Vhost) error {
+	_, err := newVhosts(base, profile, table)
+	return err
+}
+
+func newVhosts(base string, profile string, table map[string]*Vhost) (*vhosts, error) {
+	vs := &vhosts{
+		profile: profile,
+		table:   map[string]*Vhost{},
+		reverse: map[string]string{},
+	}
+	if base != "" {
+		u, err := url.Parse(base)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme == "" || u.Hostname() == "" {
+			return nil, fmt.Errorf("bad vhost base %s, should be like https://proxy.example.com", base)
+		}
+		vs.base = u
+	}
+	for name, vh := range table {
+		u, err := url.Parse(vh.Target)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("bad target %s of vhost %s", vh.Target, name)
+		}
+		name = strings.ToLower(name)
+		vs.table[name] = &Vhost{
+			Target:  vh.Target,
+			Profile: vh.Profile,
+			scheme:  strings.ToLower(u.Scheme),
+			host:    u.Host,
+		}
+		vs.reverse[strings.ToLower(u.Scheme)+"://"+strings.ToLower(u.Host)] = name
+	}
+	return vs, nil
+}
+
+// Vhosts returns the vhost table.
+func Vhosts() map[string]*Vhost {
+	result := map[string]*Vhost{}
+	if vs := getVhosts(); vs != nil {
+		for name, vh := range vs.table {
+			result[name] = vh
+		}
+	}
+	return result
+}
+
+func getVhosts() *vhosts {
+	vs, _ := currentVhosts.Load().(*vhosts)
+	return vs
+}
+
+// encodeVhostLabel encodes a host name into a single dns label, "-" is
+// escaped to "--", and "." is replaced by "-". e.g. "my-site.example.com"
+// is encoded to "my--site-example-com".
+func encodeVhostLabel(host string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(host, "-", "--"), ".", "-")
+}
+
+func decodeVhostLabel(label string) string {
+	sb := strings.Builder{}
+	for i := 0; i < len(label); i++ {
+		if label[i] != '-' {
+			sb.WriteByte(label[i])
+		} else if i+1 < len(label) && label[i+1] == '-' {
+			sb.WriteByte('-')
+			i++
+		} else {
+			sb.WriteByte('.')
+		}
+	}
+	return sb.String()
+}
+
+// resolveVhost returns the vhost for the Host header, or nil if the vhost
+// mode is disabled or the host doesn't match.
+func resolveVhost(hostHeader string) *Vhost {
+	vs := getVhosts()
+	if vs == nil || hostHeader == "" {
+		return nil
+	}
+	host := strings.ToLower(hostHeader)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if vh, ok := vs.table[host]; ok {
+		return vh
+	}
+	if vs.base == nil {
+		return nil
+	}
+	suffix := "." + strings.ToLower(vs.base.Hostname())
+	label := strings.TrimSuffix(host, suffix)
+	if label == host || label == "" || strings.Contains(label, ".") {
+		return nil
+	}
+	return &Vhost{
+		Profile: vs.profile,
+		scheme:  "https",
+		host:    decodeVhostLabel(label),
+	}
+}
+
+// IsVhost tells whether requests to the host are routed by the vhost mode.
+func IsVhost(hostHeader string) bool {
+	return resolveVhost(hostHeader) != nil
+}
+
+// relocateToVhost returns the vhost-style url for the absolute url u, or
+// nil if u can't be represented by a vhost.
+func relocateToVhost(u *url.URL, opts *Options) *url.URL {
+	vs := getVhosts()
+	if vs == nil {
+		return nil
+	}
+	var name string
+	encoded := false
+	scheme := strings.ToLower(u.Scheme)
+	if n, ok := vs.reverse[scheme+"://"+strings.ToLower(u.Host)]; ok {
+		name = n
+	} else if vs.base != nil && u.Port() == "" {
+		name = encodeVhostLabel(strings.ToLower(u.Host)) + "." + vs.base.Hostname()
+		encoded = true
+	} else {
+		return nil
+	}
+	// the target and the profile are decided by the vhost, the ones of the
+	// current request would route the url back to the current target
+	opts = opts.Clone()
+	opts.Remove(OptHost)
+	opts.Remove(OptScheme)
+	opts.Remove(OptProfile)
+	if encoded && scheme != "https" {
+		opts.Set(OptScheme.New(scheme))
+	}
+	result := &url.URL{
+		Scheme:   "http",
+		Host:     name,
+		RawQuery: u.RawQuery,
+		Fragment: u.Fragment,
+	}
+	if vs.base != nil {
+		result.Scheme = vs.base.Scheme
+		if port := vs.base.Port(); port != "" {
+			result.Host = net.JoinHostPort(name, port)
+		}
+	}
+	rawPath := u.EscapedPath()
+	if optRawPath := SortedOptionPath(opts); optRawPath != "" {
+		rawPath = "/" + optRawPath + rawPath
+	}
+	setRawPath(result, rawPath)
+	return result
+}
+
+// DevhostURL converts a vhost-style url back to a path-style url for
+// urlproxy itself, e.g. "https://www-example-com.proxy.example.com/path" to
+// "/uOptHost=www.example.com/uOptScheme=https/path". Other urls are
+// returned as is.
+func DevhostURL(u *url.URL) *url.URL {
+	if !u.IsAbs() {
+		return u
+	}
+	vh := resolveVhost(u.Host)
+	if vh == nil {
+		return u
+	}
+	cu := *u
+	cu.Scheme = ""
+	cu.Host = ""
+	after, opts, _ := extract(&cu, vh)
+	rawPath := "/" + SortedOptionPath(opts) + after.EscapedPath()
+	setRawPath(&after, rawPath)
+	return &after
+}